@@ -0,0 +1,155 @@
+package mtasts
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"log"
+	"strings"
+	"time"
+)
+
+// MinAuthKeySize is the minimal length of the key accepted by
+// NewAuthenticatedStore.
+const MinAuthKeySize = 32
+
+// authTag is mixed into the MAC to make it specific to the record format.
+const authTag = "mtasts-auth-v1"
+
+// ErrTamperedPolicy is passed to AuthenticatedStore.OnTamper when a stored
+// record fails authentication.
+var ErrTamperedPolicy = errors.New("mtasts: cached policy authentication failed")
+
+// AuthenticatedStore is the Store wrapper that protects stored records from
+// modification.
+//
+// Each record is authenticated using HMAC-SHA256 with the configured key. The
+// MAC covers the key (domain), policy ID, fetch time and policy contents and
+// is saved along with the policy ID in the underlying Store, so any Store
+// implementation can be wrapped.
+//
+// Records that fail authentication (including ones stored without
+// AuthenticatedStore) are reported via OnTamper and treated as missing.
+//
+// Note that records are not encrypted, and an attacker with write access to
+// the underlying Store can still delete records or replace a record with an
+// older authentic record for the same domain.
+type AuthenticatedStore struct {
+	Inner Store
+
+	// Called when the record loaded from Inner fails authentication. If nil,
+	// the event is logged using the standard log package.
+	OnTamper func(key string, err error)
+
+	macKey []byte
+}
+
+// NewAuthenticatedStore creates the AuthenticatedStore wrapping inner using
+// macKey as the HMAC key.
+//
+// macKey should be random and at least MinAuthKeySize bytes long.
+func NewAuthenticatedStore(inner Store, macKey []byte) (*AuthenticatedStore, error) {
+	if len(macKey) < MinAuthKeySize {
+		return nil, errors.New("mtasts: authentication key is too short")
+	}
+	return &AuthenticatedStore{
+		Inner:  inner,
+		macKey: append([]byte(nil), macKey...),
+	}, nil
+}
+
+func (s *AuthenticatedStore) mac(key, id string, fetchTime time.Time, p *Policy) ([]byte, error) {
+	h := hmac.New(sha256.New, s.macKey)
+
+	writeField := func(h hash.Hash, b []byte) {
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(len(b)))
+		h.Write(l[:])
+		h.Write(b)
+	}
+
+	var policyText bytes.Buffer
+	if p != nil {
+		// Cached policies are not necessarily valid according to
+		// Policy.Validate, so serialize them as is.
+		if _, err := writePolicy(&policyText, *p); err != nil {
+			return nil, err
+		}
+	}
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(fetchTime.UnixNano()))
+
+	writeField(h, []byte(authTag))
+	writeField(h, []byte(key))
+	writeField(h, []byte(id))
+	writeField(h, ts[:])
+	writeField(h, policyText.Bytes())
+	return h.Sum(nil), nil
+}
+
+func (s *AuthenticatedStore) tampered(key string, err error) {
+	if s.OnTamper != nil {
+		s.OnTamper(key, err)
+		return
+	}
+	log.Printf("mtasts: security: ignoring cached policy for %s: %v", key, err)
+}
+
+func (s *AuthenticatedStore) List() ([]string, error) {
+	return s.Inner.List()
+}
+
+func (s *AuthenticatedStore) Store(key string, id string, fetchTime time.Time, policy *Policy) error {
+	mac, err := s.mac(key, id, fetchTime, policy)
+	if err != nil {
+		return err
+	}
+	// Policy IDs are alphanumeric so '.' can be used as a separator.
+	sealedID := id + "." + base64.RawURLEncoding.EncodeToString(mac)
+	return s.Inner.Store(key, sealedID, fetchTime, policy)
+}
+
+func (s *AuthenticatedStore) Load(key string) (id string, fetchTime time.Time, policy *Policy, err error) {
+	sealedID, fetchTime, policy, err := s.Inner.Load(key)
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+
+	sep := strings.LastIndexByte(sealedID, '.')
+	if sep == -1 {
+		s.tampered(key, ErrTamperedPolicy)
+		return "", time.Time{}, nil, ErrNoPolicy
+	}
+	id = sealedID[:sep]
+	storedMAC, err := base64.RawURLEncoding.DecodeString(sealedID[sep+1:])
+	if err != nil {
+		s.tampered(key, ErrTamperedPolicy)
+		return "", time.Time{}, nil, ErrNoPolicy
+	}
+
+	expectedMAC, err := s.mac(key, id, fetchTime, policy)
+	if err != nil {
+		s.tampered(key, err)
+		return "", time.Time{}, nil, ErrNoPolicy
+	}
+	if !hmac.Equal(storedMAC, expectedMAC) {
+		s.tampered(key, ErrTamperedPolicy)
+		return "", time.Time{}, nil, ErrNoPolicy
+	}
+	return id, fetchTime, policy, nil
+}
+
+func (s *AuthenticatedStore) Delete(key string) error {
+	if d, ok := s.Inner.(Deleter); ok {
+		return d.Delete(key)
+	}
+	return nil
+}
+
+func (s *AuthenticatedStore) DeleteIfFetched(key string, fetchTime time.Time) (bool, error) {
+	return deleteIfFetched(s.Inner, key, fetchTime)
+}
@@ -0,0 +1,90 @@
+package mtasts
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuthenticatedStore(t *testing.T) {
+	dir := tempDir(t)
+	inner := fsStore{Dir: dir}
+
+	if _, err := NewAuthenticatedStore(inner, []byte("short")); err == nil {
+		t.Fatal("short key accepted")
+	}
+
+	s, err := NewAuthenticatedStore(inner, bytes.Repeat([]byte{0x42}, MinAuthKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tampered []string
+	s.OnTamper = func(key string, err error) {
+		tampered = append(tampered, key)
+	}
+
+	policy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.org"},
+	}
+	fetchTime := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	for _, domain := range []string{"example.org", "example.net"} {
+		if err := s.Store(domain, "1234", fetchTime, policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, loadedTime, loadedPolicy, err := s.Load("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1234" || !loadedTime.Equal(fetchTime) || !reflect.DeepEqual(loadedPolicy, policy) {
+		t.Errorf("wrong data loaded: %v %v %+v", id, loadedTime, loadedPolicy)
+	}
+
+	// Downgrade the policy.
+	path := filepath.Join(dir, "example.org")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte(`"Mode":"enforce"`), []byte(`"Mode":"none"`), 1)
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.Load("example.org"); err != ErrNoPolicy {
+		t.Errorf("expected ErrNoPolicy for modified record, got %v", err)
+	}
+
+	// Record copied from another domain.
+	data, err = ioutil.ReadFile(filepath.Join(dir, "example.net"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "example.com"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.Load("example.com"); err != ErrNoPolicy {
+		t.Errorf("expected ErrNoPolicy for copied record, got %v", err)
+	}
+
+	// Record stored without authentication.
+	if err := inner.Store("example.info", "1234", fetchTime, policy); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.Load("example.info"); err != ErrNoPolicy {
+		t.Errorf("expected ErrNoPolicy for unauthenticated record, got %v", err)
+	}
+
+	if !reflect.DeepEqual(tampered, []string{"example.org", "example.com", "example.info"}) {
+		t.Errorf("wrong OnTamper calls: %v", tampered)
+	}
+
+	if _, _, _, err := s.Load("example.net"); err != nil {
+		t.Errorf("unmodified record rejected: %v", err)
+	}
+}
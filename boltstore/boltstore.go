@@ -0,0 +1,165 @@
+// Package boltstore implements mtasts.Store using bbolt embedded database.
+//
+// All policies are kept in a single file, which makes it suitable for large
+// caches that are slow to list and back up when stored using one file per
+// domain.
+package boltstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SchemaVersion is the version of the database layout written by this
+// package.
+const SchemaVersion = "1"
+
+var (
+	metaBucket     = []byte("meta")
+	policiesBucket = []byte("policies")
+	versionKey     = []byte("schema_version")
+)
+
+type record struct {
+	ID        string
+	FetchTime time.Time
+	Policy    *mtasts.Policy
+}
+
+// Store is the mtasts.Store implementation backed by bbolt database.
+//
+// It is goroutine-safe. Only one process can have the database open at a
+// time.
+type Store struct {
+	db *bolt.DB
+}
+
+// New opens or creates the database at path.
+//
+// An error is returned if the database was created using an incompatible
+// schema version.
+func New(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(policiesBucket); err != nil {
+			return err
+		}
+
+		version := meta.Get(versionKey)
+		if version == nil {
+			return meta.Put(versionKey, []byte(SchemaVersion))
+		}
+		if string(version) != SchemaVersion {
+			return fmt.Errorf("mtasts/boltstore: unsupported schema version: %s", version)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) List() ([]string, error) {
+	var domains []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(policiesBucket).ForEach(func(k, _ []byte) error {
+			domains = append(domains, string(k))
+			return nil
+		})
+	})
+	return domains, err
+}
+
+func (s *Store) Store(key, id string, fetchTime time.Time, p *mtasts.Policy) error {
+	if key == "" {
+		return errors.New("mtasts/boltstore: empty key")
+	}
+
+	blob, err := json.Marshal(record{ID: id, FetchTime: fetchTime, Policy: p})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(policiesBucket).Put([]byte(key), blob)
+	})
+}
+
+func (s *Store) Load(key string) (id string, fetchTime time.Time, p *mtasts.Policy, err error) {
+	var rec record
+	err = s.db.View(func(tx *bolt.Tx) error {
+		blob := tx.Bucket(policiesBucket).Get([]byte(key))
+		if blob == nil {
+			return mtasts.ErrNoPolicy
+		}
+		return json.Unmarshal(blob, &rec)
+	})
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+	return rec.ID, rec.FetchTime, rec.Policy, nil
+}
+
+func (s *Store) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(policiesBucket).Delete([]byte(key))
+	})
+}
+
+func (s *Store) DeleteIfFetched(key string, fetchTime time.Time) (bool, error) {
+	deleted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(policiesBucket)
+		blob := b.Get([]byte(key))
+		if blob == nil {
+			return nil
+		}
+		var rec record
+		if err := json.Unmarshal(blob, &rec); err != nil {
+			return err
+		}
+		if !rec.FetchTime.Equal(fetchTime) {
+			return nil
+		}
+		deleted = true
+		return b.Delete([]byte(key))
+	})
+	return deleted, err
+}
+
+// NewCache creates the Cache object using the bbolt database at path to
+// store cached policies.
+//
+// The Store can be closed using the Close method of the Cache.Store
+// (asserted to *Store).
+func NewCache(path string) (*mtasts.Cache, error) {
+	store, err := New(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mtasts.Cache{
+		Store:    store,
+		Resolver: net.DefaultResolver,
+	}, nil
+}
@@ -0,0 +1,111 @@
+package boltstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+	bolt "go.etcd.io/bbolt"
+)
+
+func tempDB(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mtasts-boltstore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "cache.db")
+}
+
+func TestStore(t *testing.T) {
+	path := tempDB(t)
+	s, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := s.Load("example.org"); err != mtasts.ErrNoPolicy {
+		t.Fatalf("expected ErrNoPolicy, got %v", err)
+	}
+
+	policy := &mtasts.Policy{
+		Mode:   mtasts.ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.org"},
+	}
+	fetchTime := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	for _, domain := range []string{"example.org", "example.com"} {
+		if err := s.Store(domain, "1234", fetchTime, policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Data should persist across reopens.
+	s, err = New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []string{"example.org"}) {
+		t.Fatalf("wrong list: %v", list)
+	}
+
+	id, loadedTime, loadedPolicy, err := s.Load("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1234" || !loadedTime.Equal(fetchTime) || !reflect.DeepEqual(loadedPolicy, policy) {
+		t.Fatalf("wrong data loaded: %v %v %+v", id, loadedTime, loadedPolicy)
+	}
+
+	if deleted, err := s.DeleteIfFetched("example.org", fetchTime.Add(time.Hour)); err != nil || deleted {
+		t.Fatalf("DeleteIfFetched with wrong fetch time: %v %v", deleted, err)
+	}
+	if deleted, err := s.DeleteIfFetched("example.org", fetchTime); err != nil || !deleted {
+		t.Fatalf("DeleteIfFetched with current fetch time: %v %v", deleted, err)
+	}
+	if _, _, _, err := s.Load("example.org"); err != mtasts.ErrNoPolicy {
+		t.Fatalf("expected ErrNoPolicy after DeleteIfFetched, got %v", err)
+	}
+}
+
+func TestStore_SchemaVersion(t *testing.T) {
+	path := tempDB(t)
+
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(metaBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(versionKey, []byte("999"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if s, err := New(path); err == nil {
+		s.Close()
+		t.Fatal("expected an error for unsupported schema version")
+	}
+}
@@ -1,51 +1,113 @@
 package mtasts
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"mime"
 	"net"
 	"net/http"
 	"runtime/trace"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+func noRedirects(req *http.Request, via []*http.Request) error {
+	return errors.New("mtasts: HTTP redirects are forbidden")
+}
+
 var httpClient = &http.Client{
-	CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		return errors.New("mtasts: HTTP redirects are forbidden")
-	},
-	Timeout: time.Minute,
+	CheckRedirect: noRedirects,
+	Timeout:       time.Minute,
 }
 
-func downloadPolicy(ctx context.Context, domain string) (*Policy, error) {
+// DefaultMaxPolicySize is the policy size limit used if Cache.MaxPolicySize
+// is not set.
+const DefaultMaxPolicySize = 64 * 1024
+
+// DefaultFetchTimeout is the time limit for the lookup shared by concurrent
+// Get calls used if Cache.FetchTimeout is not set.
+const DefaultFetchTimeout = 2 * time.Minute
+
+func (c *Cache) downloadPolicy(ctx context.Context, domain string) (*Policy, error) {
 	// TODO: Consult OCSP/CRL to detect revoked certificates?
 
+	client := c.HTTPClient
+	if client == nil {
+		client = httpClient
+	} else {
+		// HTTP 3xx redirects MUST NOT be followed, no matter what the
+		// caller wants.
+		clientCpy := *client
+		clientCpy.CheckRedirect = noRedirects
+		client = &clientCpy
+	}
+
 	req, err := newRequestWithContext(ctx, "GET", "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
 	if err != nil {
-		return nil, err
+		return nil, FetchError{Reason: FetchDownloadFailed, Domain: domain, Err: err}
 	}
-	resp, err := httpClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, FetchError{Reason: FetchDownloadFailed, Domain: domain, Err: err}
 	}
 	defer resp.Body.Close()
 
 	// Policies fetched via HTTPS are only valid if the HTTP response code is
 	// 200 (OK).  HTTP 3xx redirects MUST NOT be followed.
 	if resp.StatusCode != 200 {
-		return nil, errors.New("mtasts: HTTP " + resp.Status)
+		return nil, FetchError{Reason: FetchHTTPStatus, Domain: domain, Err: errors.New("HTTP " + resp.Status)}
 	}
 
-	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	contentType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
 	if err != nil {
-		return nil, err
+		return nil, FetchError{Reason: FetchContentType, Domain: domain, Err: err}
 	}
 
 	if contentType != "text/plain" {
-		return nil, errors.New("mtasts: unexpected content type")
+		return nil, FetchError{Reason: FetchContentType, Domain: domain, Err: errors.New(contentType)}
+	}
+
+	// Policy text is ASCII-only per ABNF, so anything ASCII-compatible
+	// is fine.
+	if charset, ok := params["charset"]; ok {
+		switch strings.ToLower(charset) {
+		case "us-ascii", "utf-8":
+		default:
+			return nil, FetchError{Reason: FetchCharset, Domain: domain, Err: errors.New(charset)}
+		}
 	}
 
-	return readPolicy(resp.Body)
+	maxSize := c.MaxPolicySize
+	if maxSize == 0 {
+		maxSize = DefaultMaxPolicySize
+	}
+	if resp.ContentLength > maxSize {
+		return nil, FetchError{Reason: FetchPolicyTooLarge, Domain: domain,
+			Err: fmt.Errorf("Content-Length %d exceeds the limit of %d bytes", resp.ContentLength, maxSize)}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, FetchError{Reason: FetchDownloadFailed, Domain: domain, Err: err}
+	}
+	if int64(len(body)) > maxSize {
+		return nil, FetchError{Reason: FetchPolicyTooLarge, Domain: domain,
+			Err: fmt.Errorf("policy exceeds the limit of %d bytes", maxSize)}
+	}
+
+	policy, err := readPolicy(bytes.NewReader(body))
+	if err != nil {
+		if _, ok := err.(MalformedPolicyError); ok {
+			return nil, FetchError{Reason: FetchMalformedPolicy, Domain: domain, Err: err}
+		}
+		return nil, FetchError{Reason: FetchDownloadFailed, Domain: domain, Err: err}
+	}
+	return policy, nil
 }
 
 type Resolver interface {
@@ -66,6 +128,55 @@ type Store interface {
 	Load(key string) (id string, fetchTime time.Time, policy *Policy, err error)
 }
 
+// Deleter is an optional interface that can be implemented by Store to allow
+// Cache.Refresh to evict stale entries.
+type Deleter interface {
+	// Delete removes the cached policy data for the key.
+	//
+	// Deleting the key that is not present in the store is not an error.
+	Delete(key string) error
+}
+
+// ConditionalDeleter is an optional interface that can be implemented by Store
+// to make eviction of stale entries safe when the Store is shared between
+// multiple Cache instances.
+//
+// If Store implements only Deleter, a policy stored by another instance
+// between the expiry check and the deletion is removed.
+type ConditionalDeleter interface {
+	// DeleteIfFetched removes the cached policy data for the key only if it
+	// was stored with the specified fetch time. The check and the removal
+	// should be atomic.
+	//
+	// It returns false if the key is not present in the store or was stored
+	// with a different fetch time.
+	DeleteIfFetched(key string, fetchTime time.Time) (bool, error)
+}
+
+// deleteIfFetched removes the key from s if it was stored with the specified
+// fetch time. It uses ConditionalDeleter if s implements it, otherwise
+// Deleter.
+func deleteIfFetched(s Store, key string, fetchTime time.Time) (bool, error) {
+	if d, ok := s.(ConditionalDeleter); ok {
+		return d.DeleteIfFetched(key, fetchTime)
+	}
+	d, ok := s.(Deleter)
+	if !ok {
+		return false, nil
+	}
+	_, storedTime, _, err := s.Load(key)
+	if err != nil {
+		if err == ErrNoPolicy {
+			return false, nil
+		}
+		return false, err
+	}
+	if !storedTime.Equal(fetchTime) {
+		return false, nil
+	}
+	return true, d.Delete(key)
+}
+
 // Cache structure implements transparent MTA-STS policy caching using provided
 // Store implementation.
 //
@@ -80,10 +191,58 @@ type Cache struct {
 
 	// If non-nil replaces the function used to download policy texts.
 	DownloadPolicy func(domain string) (*Policy, error)
+
+	// HTTP client used to download policies. If nil, the client with
+	// one-minute timeout and default transport is used.
+	//
+	// Redirects are never followed, CheckRedirect value is ignored.
+	HTTPClient *http.Client
+
+	// Maximum size of the policy text in bytes. If zero,
+	// DefaultMaxPolicySize is used.
+	MaxPolicySize int64
+
+	// Time limit for the lookup done by Get. It is not affected by the
+	// caller's context since the lookup is shared by concurrent callers. If
+	// zero, DefaultFetchTimeout is used.
+	FetchTimeout time.Duration
+
+	// Maximum amount of domains refreshed in parallel by RefreshContext. If
+	// zero, domains are refreshed sequentially.
+	//
+	// Store and Resolver must be goroutine-safe if it is greater than 1.
+	RefreshConcurrency int
+
+	// If non-zero, limits time spent refreshing a single domain by
+	// RefreshContext.
+	RefreshTimeout time.Duration
+
+	// If non-nil, replaces time.Now as the source of the current time used
+	// for policy expiry, fetch timestamps and refresh look-ahead.
+	//
+	// Store implementations that depend on the current time, such as
+	// preload.PreloadedCache, have to be configured separately.
+	Now func() time.Time
+
+	fetchesLock sync.Mutex
+	fetches     map[string]*fetchCall
+}
+
+func (c *Cache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
 }
 
+// IsNoPolicy reports whether the error returned by Cache.Get means that the
+// domain has no usable MTA-STS policy.
 func IsNoPolicy(err error) bool {
-	return err == ErrNoPolicy
+	if err == ErrNoPolicy {
+		return true
+	}
+	_, ok := err.(FetchError)
+	return ok
 }
 
 // ErrNoPolicy indicates that remote domain does not offer a MTA-STS policy or
@@ -96,35 +255,181 @@ var ErrNoPolicy = errors.New("mtasts: no policy")
 // Get reads policy from cache or tries to fetch it from Policy Host.
 //
 // The domain is assumed to be normalized, as done by dns.ForLookup.
+//
+// Concurrent Get calls for the same domain share a single lookup. If ctx is
+// cancelled, Get returns the cached policy if it is still valid or
+// ctx.Err() otherwise without waiting for the shared lookup, other callers
+// are not affected.
 func (c *Cache) Get(ctx context.Context, domain string) (*Policy, error) {
-	_, p, err := c.fetch(ctx, false, time.Now(), domain)
-	return p, err
+	return c.fetchShared(ctx, domain)
 }
 
+// Refresh checks all policies in the cache and refetches them if they are
+// going to expire soon or if the domain published a new policy.
+//
+// It is equivalent to RefreshContext with context.Background().
+//
+// See Refresher for the periodic refresh with per-domain scheduling.
 func (c *Cache) Refresh() error {
-	refreshCtx, refreshTask := trace.NewTask(context.Background(), "mtasts.Cache/Refresh")
+	_, err := c.RefreshContext(context.Background())
+	return err
+}
+
+// RefreshReport contains results of the Cache refresh.
+//
+// Domain lists are sorted.
+type RefreshReport struct {
+	// Domains for which a new policy was fetched and stored.
+	Refreshed []string
+	// Domains that were checked, but the cached policy is still up to date.
+	Unchanged []string
+	// Domains for which the refresh failed. Cached policies that are still
+	// valid are kept and used by Get.
+	Failed map[string]error
+	// Domains that were not checked at all, either because the refresh was
+	// cancelled or because their policies are not going to expire soon.
+	Skipped []string
+	// Domains removed from the cache since their policies expired and they
+	// no longer publish the MTA-STS record.
+	Evicted []string
+}
+
+// defaultLookAhead is the look-ahead used by RefreshContext.
+//
+// If policy is going to expire in next 6 hours (half of our refresh period)
+// - we still want to refresh it. Since otherwise we are going to have
+// expired policy for another 6 hours, which makes it useless.
+// See https://tools.ietf.org/html/rfc8461#section-10.2.
+const defaultLookAhead = 6 * time.Hour
+
+// RefreshContext is similar to Refresh but allows to cancel the refresh and
+// returns the detailed report.
+//
+// Up to RefreshConcurrency domains are refreshed in parallel, each limited
+// by RefreshTimeout. When ctx is cancelled, the domains that were not
+// processed yet are reported as skipped and ctx.Err() is returned along with
+// the report.
+//
+// If Store implements Deleter, expired policies for domains that no longer
+// publish the MTA-STS record are removed from the cache. Stores shared between
+// multiple Cache instances should also implement ConditionalDeleter.
+func (c *Cache) RefreshContext(ctx context.Context) (*RefreshReport, error) {
+	return c.refresh(ctx, func(string) time.Duration { return defaultLookAhead }, nil)
+}
+
+// refresh implements RefreshContext. Policies expiring within lookAhead(domain)
+// are refetched. If skip is not nil, it is called sequentially for each domain
+// and domains it returns true for are reported as skipped.
+func (c *Cache) refresh(ctx context.Context, lookAhead func(domain string) time.Duration, skip func(domain string) bool) (*RefreshReport, error) {
+	ctx, refreshTask := trace.NewTask(ctx, "mtasts.Cache/Refresh")
 	defer refreshTask.End()
 
 	list, err := c.Store.List()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	concurrency := c.RefreshConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
 	}
 
-	for _, ent := range list {
-		// If policy is going to expire in next 6 hours (half of our refresh
-		// period) - we still want to refresh it.
-		// Since otherwise we are going to have expired policy for another 6 hours,
-		// which makes it useless.
-		// See https://tools.ietf.org/html/rfc8461#section-10.2.
-		_, _, _ = c.fetch(refreshCtx, false, time.Now().Add(6*time.Hour), ent)
+	var (
+		report = &RefreshReport{Failed: make(map[string]error)}
+		lock   sync.Mutex
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, concurrency)
+	)
+	for _, domain := range list {
+		if skip != nil && skip(domain) {
+			report.Skipped = append(report.Skipped, domain)
+			continue
+		}
+
+		if ctx.Err() != nil {
+			report.Skipped = append(report.Skipped, domain)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			report.Skipped = append(report.Skipped, domain)
+			continue
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(domain string) {
+			defer wg.Done()
+			defer func() { <-sem }()
 
-		// TODO: figure out how to clean stale entires from cache
-		// and if this is really necessary.
+			domainCtx := ctx
+			if c.RefreshTimeout != 0 {
+				var cancel context.CancelFunc
+				domainCtx, cancel = context.WithTimeout(ctx, c.RefreshTimeout)
+				defer cancel()
+			}
+
+			cacheHit, _, err := c.fetch(domainCtx, false, c.now().Add(lookAhead(domain)), domain)
+			evicted := false
+			if err != nil {
+				evicted = c.evictStale(domain, err)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			switch {
+			case evicted:
+				report.Evicted = append(report.Evicted, domain)
+			case err != nil:
+				report.Failed[domain] = err
+			case cacheHit:
+				report.Unchanged = append(report.Unchanged, domain)
+			default:
+				report.Refreshed = append(report.Refreshed, domain)
+			}
+		}(domain)
+	}
+	wg.Wait()
+
+	sort.Strings(report.Refreshed)
+	sort.Strings(report.Unchanged)
+	sort.Strings(report.Skipped)
+	sort.Strings(report.Evicted)
+
+	return report, ctx.Err()
+}
+
+// evictStale removes the cached policy for the domain if it is expired and
+// the domain no longer publishes the MTA-STS record, as indicated by
+// fetchErr.
+//
+// RFC 8461 notes that the absence of the TXT record alone is not
+// sufficient to remove the cached policy. Expired policies are not used
+// anyway, so it is safe to remove them. The policy is removed only if it was
+// not replaced after the expiry check.
+func (c *Cache) evictStale(domain string, fetchErr error) bool {
+	if ferr, ok := fetchErr.(FetchError); !ok || ferr.Reason != FetchNoRecord {
+		return false
+	}
+
+	_, fetchTime, policy, err := c.Store.Load(domain)
+	if err != nil {
+		return false
+	}
+	if !fetchTime.Add(time.Duration(policy.MaxAge) * time.Second).Before(c.now()) {
+		return false
 	}
 
-	return nil
+	deleted, err := deleteIfFetched(c.Store, domain, fetchTime)
+	return deleted && err == nil
 }
 
+// fetch returns the policy for the domain, using the cached one if it is
+// still valid at now and its ID matches the DNS record.
+//
+// If the lookup fails but the cached policy is still valid, it is returned
+// along with the error. Callers that only need a usable policy should
+// ignore err if p is not nil.
 func (c *Cache) fetch(ctx context.Context, ignoreDns bool, now time.Time, domain string) (cacheHit bool, p *Policy, err error) {
 	defer trace.StartRegion(ctx, "mtasts.Cache/fetch").End()
 
@@ -140,12 +445,11 @@ func (c *Cache) fetch(ctx context.Context, ignoreDns bool, now time.Time, domain
 	if !ignoreDns {
 		records, err := c.Resolver.LookupTXT(ctx, "_mta-sts."+domain)
 		if err != nil {
-			if validCache {
-				return true, cachedPolicy, nil
-			}
-
 			if derr, ok := err.(*net.DNSError); ok && !derr.IsTemporary {
-				return false, nil, ErrNoPolicy
+				err = FetchError{Reason: FetchNoRecord, Domain: domain, Err: err}
+			}
+			if validCache {
+				return true, cachedPolicy, err
 			}
 			return false, nil, err
 		}
@@ -158,17 +462,22 @@ func (c *Cache) fetch(ctx context.Context, ignoreDns bool, now time.Time, domain
 		//   sufficient to remove a sender's previously cached policy for the Policy
 		//   Domain, as discussed in Section 5.1, "Policy Application Control Flow".)
 		if len(records) != 1 {
+			err := FetchError{Reason: FetchMultipleRecords, Domain: domain}
+			if len(records) == 0 {
+				err.Reason = FetchNoRecord
+			}
 			if validCache {
-				return true, cachedPolicy, nil
+				return true, cachedPolicy, err
 			}
-			return false, nil, ErrNoPolicy
+			return false, nil, err
 		}
 		dnsId, err = readDNSRecord(records[0])
 		if err != nil {
+			err = FetchError{Reason: FetchMalformedRecord, Domain: domain, Err: err}
 			if validCache {
-				return true, cachedPolicy, nil
+				return true, cachedPolicy, err
 			}
-			return false, nil, ErrNoPolicy
+			return false, nil, err
 		}
 	}
 
@@ -180,19 +489,21 @@ func (c *Cache) fetch(ctx context.Context, ignoreDns bool, now time.Time, domain
 		if c.DownloadPolicy != nil {
 			policy, err = c.DownloadPolicy(domain)
 		} else {
-			policy, err = downloadPolicy(ctx, domain)
+			policy, err = c.downloadPolicy(ctx, domain)
 		}
 		if err != nil {
+			if _, ok := err.(FetchError); !ok {
+				err = FetchError{Reason: FetchDownloadFailed, Domain: domain, Err: err}
+			}
 			if validCache {
-				return true, cachedPolicy, nil
+				return true, cachedPolicy, err
 			}
-			return false, nil, ErrNoPolicy
+			return false, nil, err
 		}
 
-		if err := c.Store.Store(domain, dnsId, time.Now(), policy); err != nil {
-			// We still got up-to-date policy, cache is not critcial.
-			return false, cachedPolicy, nil
-		}
+		// Failure to store is not critical, we still got up-to-date policy and
+		// it should be used instead of the cached one.
+		_ = c.Store.Store(domain, dnsId, c.now(), policy)
 		return false, policy, nil
 	}
 
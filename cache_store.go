@@ -2,18 +2,72 @@ package mtasts
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/net/idna"
 )
 
+// fsStore stores each policy in a separate file in Dir.
+//
+// Access is synchronized using an advisory lock on the .lock file in Dir,
+// so multiple processes can share the same directory.
 type fsStore struct {
 	Dir string
 }
 
+const fsLockName = ".lock"
+
+func (s fsStore) lock(exclusive bool) (unlock func(), err error) {
+	return lockFile(filepath.Join(s.Dir, fsLockName), exclusive)
+}
+
+// fsKeyProfile is idna.Lookup that allows underscores, they are checked
+// separately by fsKey.
+var fsKeyProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// fsKey converts the domain into the file name used by fsStore.
+//
+// Domains are stored in the lower-case A-label form. Anything that is not a
+// valid domain name is rejected so keys cannot escape the directory. Names
+// ending with ".tmp" are reserved for temporary files.
+func fsKey(domain string) (string, error) {
+	key, err := fsKeyProfile.ToASCII(strings.TrimSuffix(domain, "."))
+	if err != nil {
+		return "", fmt.Errorf("mtasts: invalid cache key %q: %w", domain, err)
+	}
+	key = strings.ToLower(key)
+
+	if key == "" || len(key) > 253 || strings.HasSuffix(key, ".tmp") {
+		return "", fmt.Errorf("mtasts: invalid cache key %q", domain)
+	}
+	for _, label := range strings.Split(key, ".") {
+		if label == "" {
+			return "", fmt.Errorf("mtasts: invalid cache key %q: empty label", domain)
+		}
+		for _, r := range label {
+			if !isAlnum(r) && r != '-' && r != '_' {
+				return "", fmt.Errorf("mtasts: invalid cache key %q: invalid character %q", domain, r)
+			}
+		}
+	}
+	return key, nil
+}
+
+// fsTempPattern returns the pattern for temporary files used when writing
+// key.
+//
+// It starts with a dot so they are never a valid key.
+func fsTempPattern(key string) string {
+	return "." + key + ".*.tmp"
+}
+
 func (s fsStore) List() ([]string, error) {
 	info, err := ioutil.ReadDir(s.Dir)
 	if err != nil {
@@ -21,18 +75,36 @@ func (s fsStore) List() ([]string, error) {
 	}
 	domains := make([]string, 0, len(info))
 	for _, ent := range info {
-		if ent.IsDir() {
+		if !ent.Mode().IsRegular() {
+			continue
+		}
+		// Skip temporary files and anything else not created by fsStore.
+		if key, err := fsKey(ent.Name()); err != nil || key != ent.Name() {
 			continue
 		}
-		domains = append(domains, ent.Name())
+		domain, err := idna.ToUnicode(ent.Name())
+		if err != nil {
+			continue
+		}
+		domains = append(domains, domain)
 	}
 	return domains, nil
 }
 
 func (s fsStore) Store(domain, id string, fetchTime time.Time, p *Policy) error {
-	path := filepath.Join(s.Dir, domain)
+	key, err := fsKey(domain)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.Dir, key)
+
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	f, err := os.Create(path + ".tmp")
+	f, err := ioutil.TempFile(s.Dir, fsTempPattern(key))
 	if err != nil {
 		return err
 	}
@@ -44,14 +116,69 @@ func (s fsStore) Store(domain, id string, fetchTime time.Time, p *Policy) error
 		"Policy":    p,
 	})
 	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		os.Remove(f.Name())
 		return err
 	}
 
-	return os.Rename(f.Name(), path)
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return syncDir(s.Dir)
+}
+
+// syncDir makes sure the directory entries are persisted to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s fsStore) Delete(domain string) error {
+	key, err := fsKey(domain)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = os.Remove(filepath.Join(s.Dir, key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 func (s fsStore) Load(domain string) (id string, fetchTime time.Time, p *Policy, err error) {
-	f, err := os.Open(filepath.Join(s.Dir, domain))
+	key, err := fsKey(domain)
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+
+	unlock, err := s.lock(false)
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+	defer unlock()
+
+	return s.load(key)
+}
+
+// load reads the file for key. The caller should hold the lock.
+func (s fsStore) load(key string) (id string, fetchTime time.Time, p *Policy, err error) {
+	f, err := os.Open(filepath.Join(s.Dir, key))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return "", time.Time{}, nil, ErrNoPolicy
@@ -71,13 +198,119 @@ func (s fsStore) Load(domain string) (id string, fetchTime time.Time, p *Policy,
 	return data.ID, data.FetchTime, data.Policy, nil
 }
 
+func (s fsStore) DeleteIfFetched(domain string, fetchTime time.Time) (bool, error) {
+	key, err := fsKey(domain)
+	if err != nil {
+		return false, err
+	}
+
+	unlock, err := s.lock(true)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	_, storedTime, _, err := s.load(key)
+	if err != nil {
+		if err == ErrNoPolicy {
+			return false, nil
+		}
+		return false, err
+	}
+	if !storedTime.Equal(fetchTime) {
+		return false, nil
+	}
+	if err := os.Remove(filepath.Join(s.Dir, key)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// cleanupTemp removes temporary files left behind by interrupted Store
+// calls.
+func (s fsStore) cleanupTemp() error {
+	// Make sure no other process is in the middle of Store.
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	info, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range info {
+		name := ent.Name()
+		// Previous versions used <key>.tmp without the leading dot.
+		if !ent.Mode().IsRegular() || !strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.Dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateKeys renames files created by previous versions that used domain
+// names as is (e.g. in U-label form) to the current key format.
+//
+// If the file with the current key already exists, it was written after the
+// upgrade and the legacy file is removed.
+func (s fsStore) migrateKeys() error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	info, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range info {
+		name := ent.Name()
+		if !ent.Mode().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		key, err := fsKey(name)
+		if err != nil || key == name {
+			continue
+		}
+
+		legacyPath := filepath.Join(s.Dir, name)
+		path := filepath.Join(s.Dir, key)
+		if _, err := os.Stat(path); err == nil {
+			if err := os.Remove(legacyPath); err != nil {
+				return err
+			}
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(legacyPath, path); err != nil {
+			return err
+		}
+	}
+	return syncDir(s.Dir)
+}
+
 // NewFSCache creates the Cache object using FS directory to store cached
 // policies.
 //
-// The specified directory should exist and be writtable.
+// The specified directory should exist and be writtable. Temporary files
+// left behind by previous runs are removed and files created by previous
+// versions of the library are converted to the current format.
 func NewFSCache(directory string) *Cache {
+	store := fsStore{Dir: directory}
+	// Not critical, leftovers are ignored by List anyway.
+	_ = store.cleanupTemp()
+	// Policies for affected domains will be fetched again on failure.
+	_ = store.migrateKeys()
+
 	return &Cache{
-		Store:    fsStore{Dir: directory},
+		Store:    store,
 		Resolver: net.DefaultResolver,
 	}
 }
@@ -127,6 +360,26 @@ func (s *ramStore) Load(key string) (id string, fetchTime time.Time, policy *Pol
 	return data.id, data.fetchtime, data.policy, nil
 }
 
+func (s *ramStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.m, key)
+	return nil
+}
+
+func (s *ramStore) DeleteIfFetched(key string, fetchTime time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, ok := s.m[key]
+	if !ok || !data.fetchtime.Equal(fetchTime) {
+		return false, nil
+	}
+	delete(s.m, key)
+	return true, nil
+}
+
 func newRAMStore() *ramStore {
 	return &ramStore{m: make(map[string]struct {
 		id        string
@@ -155,6 +408,10 @@ func (nopStore) Store(key string, id string, fetchTime time.Time, policy *Policy
 	return nil
 }
 
+func (nopStore) Delete(key string) error {
+	return nil
+}
+
 func (nopStore) Load(key string) (id string, fetchTime time.Time, policy *Policy, err error) {
 	return "", time.Time{}, nil, ErrNoPolicy
 }
@@ -0,0 +1,208 @@
+package mtasts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mtasts-fsstore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestFSStore(t *testing.T) {
+	dir := tempDir(t)
+	s := fsStore{Dir: dir}
+
+	policy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.org"},
+	}
+	fetchTime := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	for _, domain := range []string{"example.org", "ñaca.com", "Example.NET.", "_sub.example.org"} {
+		if err := s.Store(domain, "1234", fetchTime, policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Leftover from the interrupted write.
+	if err := ioutil.WriteFile(filepath.Join(dir, ".example.com.tmp"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(list)
+	if !reflect.DeepEqual(list, []string{"_sub.example.org", "example.net", "example.org", "ñaca.com"}) {
+		t.Fatalf("wrong list: %v", list)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "xn--aca-6ma.com")); err != nil {
+		t.Errorf("IDN domain should be stored in A-label form: %v", err)
+	}
+
+	id, loadedTime, loadedPolicy, err := s.Load("xn--aca-6ma.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1234" || !loadedTime.Equal(fetchTime) || !reflect.DeepEqual(loadedPolicy, policy) {
+		t.Fatalf("wrong data loaded: %v %v %+v", id, loadedTime, loadedPolicy)
+	}
+
+	if deleted, err := s.DeleteIfFetched("example.net", fetchTime.Add(time.Hour)); err != nil || deleted {
+		t.Fatalf("DeleteIfFetched with wrong fetch time: %v %v", deleted, err)
+	}
+	if deleted, err := s.DeleteIfFetched("example.net", fetchTime); err != nil || !deleted {
+		t.Fatalf("DeleteIfFetched with current fetch time: %v %v", deleted, err)
+	}
+	if _, _, _, err := s.Load("example.net"); err != ErrNoPolicy {
+		t.Fatalf("expected ErrNoPolicy after DeleteIfFetched, got %v", err)
+	}
+
+	NewFSCache(dir)
+	if _, err := os.Stat(filepath.Join(dir, ".example.com.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+	if _, _, _, err := s.Load("example.org"); err != nil {
+		t.Errorf("policy removed by cleanup: %v", err)
+	}
+}
+
+func TestFSStore_InvalidKey(t *testing.T) {
+	dir := tempDir(t)
+	s := fsStore{Dir: filepath.Join(dir, "cache")}
+	if err := os.Mkdir(s.Dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"", ".", "..", "../escape", "a/b", "a..b", ".hidden", "a\x00b", "a*b", "example.tmp"} {
+		t.Run(key, func(t *testing.T) {
+			if err := s.Store(key, "1234", time.Now(), &Policy{Mode: ModeNone}); err == nil {
+				t.Error("Store accepted invalid key")
+			}
+			if _, _, _, err := s.Load(key); err == nil {
+				t.Error("Load accepted invalid key")
+			}
+			if err := s.Delete(key); err == nil {
+				t.Error("Delete accepted invalid key")
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "escape")); !os.IsNotExist(err) {
+		t.Fatalf("file created outside of the store directory: %v", err)
+	}
+}
+
+func TestFSStore_Concurrent(t *testing.T) {
+	dir := tempDir(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Separate store objects with their own lock file descriptors,
+			// as if used by different processes.
+			s := fsStore{Dir: dir}
+			for j := 0; j < 20; j++ {
+				policy := &Policy{Mode: ModeEnforce, MaxAge: i*100 + j, MX: []string{"mx.example.org"}}
+				if err := s.Store("example.org", "1234", time.Now(), policy); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, _, _, err := s.Load("example.org"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	info, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ent := range info {
+		if ent.Name() != "example.org" && ent.Name() != fsLockName {
+			t.Errorf("unexpected file left in the store directory: %v", ent.Name())
+		}
+	}
+}
+
+func TestNewFSCache_LegacyKeys(t *testing.T) {
+	dir := tempDir(t)
+
+	policy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.org"},
+	}
+	legacy := []byte(`{"ID":"1234","FetchTime":"2019-04-01T00:00:00Z","Policy":{"Mode":"enforce","MaxAge":86400,"MX":["mx.example.org"]}}` + "\n")
+	// Files created by versions that used the domain as is.
+	for _, name := range []string{"ñaca.com", "ñaca.net", "Example.ORG."} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), legacy, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Leftovers from interrupted writes of previous versions.
+	for _, name := range []string{"ñaca.com.tmp", "example.org.tmp"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("{"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Written after the upgrade, should not be replaced.
+	s := fsStore{Dir: dir}
+	if err := s.Store("ñaca.net", "5678", time.Now(), policy); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewFSCache(dir)
+
+	list, err := c.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(list)
+	if !reflect.DeepEqual(list, []string{"example.org", "ñaca.com", "ñaca.net"}) {
+		t.Fatalf("wrong list: %v", list)
+	}
+
+	id, _, loadedPolicy, err := c.Store.Load("ñaca.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1234" || !reflect.DeepEqual(loadedPolicy, policy) {
+		t.Errorf("wrong data loaded: %v %+v", id, loadedPolicy)
+	}
+	if id, _, _, err := c.Store.Load("ñaca.net"); err != nil || id != "5678" {
+		t.Errorf("newer policy replaced by the legacy one: %v %v", id, err)
+	}
+
+	info, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ent := range info {
+		switch ent.Name() {
+		case "example.org", "xn--aca-6ma.com", "xn--aca-6ma.net", fsLockName:
+		default:
+			t.Errorf("unexpected file left in the store directory: %v", ent.Name())
+		}
+	}
+}
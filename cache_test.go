@@ -3,7 +3,13 @@ package mtasts
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +22,20 @@ func mockDownloadPolicy(policy *Policy, err error) func(string) (*Policy, error)
 	}
 }
 
+func checkFetchError(t *testing.T, err error, reason FetchErrorReason) {
+	t.Helper()
+	if !IsNoPolicy(err) {
+		t.Fatalf("policy get: %v", err)
+	}
+	ferr, ok := err.(FetchError)
+	if !ok {
+		t.Fatalf("expected FetchError, got %T: %v", err, err)
+	}
+	if ferr.Reason != reason {
+		t.Fatalf("wrong failure reason, want %v, got %v", reason, ferr.Reason)
+	}
+}
+
 func TestCacheGet(t *testing.T) {
 	expectedPolicy := &Policy{
 		Mode:   ModeEnforce,
@@ -53,9 +73,7 @@ func TestCacheGet_Error_DNS(t *testing.T) {
 	}
 
 	_, err := c.Get(context.Background(), "example.org")
-	if err != ErrNoPolicy {
-		t.Fatalf("policy get: %v", err)
-	}
+	checkFetchError(t, err, FetchNoRecord)
 }
 
 func TestCacheGet_Error_HTTPS(t *testing.T) {
@@ -72,8 +90,48 @@ func TestCacheGet_Error_HTTPS(t *testing.T) {
 	}
 
 	_, err := c.Get(context.Background(), "example.org")
-	if err != ErrNoPolicy {
-		t.Fatalf("policy get: %v", err)
+	checkFetchError(t, err, FetchDownloadFailed)
+}
+
+func TestCacheGet_Error_Record(t *testing.T) {
+	cases := []struct {
+		records []string
+		reason  FetchErrorReason
+	}{
+		{
+			records: []string{},
+			reason:  FetchNoRecord,
+		},
+		{
+			records: []string{"v=STSv1; id=1234", "v=STSv1; id=2345"},
+			reason:  FetchMultipleRecords,
+		},
+		{
+			records: []string{"v=STSv1; id=12-34"},
+			reason:  FetchMalformedRecord,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprint(c.records), func(t *testing.T) {
+			cache := Cache{
+				Store: newRAMStore(),
+				Resolver: &mockdns.Resolver{
+					Zones: map[string]mockdns.Zone{
+						"_mta-sts.example.org.": {
+							TXT: c.records,
+						},
+					},
+				},
+				DownloadPolicy: mockDownloadPolicy(nil, errors.New("broken")),
+			}
+
+			_, err := cache.Get(context.Background(), "example.org")
+			checkFetchError(t, err, c.reason)
+			if !errors.Is(err, ErrNoPolicy) {
+				t.Fatalf("errors.Is(err, ErrNoPolicy) is false for %v", err)
+			}
+		})
 	}
 }
 
@@ -158,6 +216,40 @@ func TestCacheGet_Expired(t *testing.T) {
 	}
 }
 
+func TestCacheGet_Expired_Clock(t *testing.T) {
+	t.Parallel()
+
+	cachedPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"a"},
+	}
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	c := Cache{
+		Store:          newRAMStore(),
+		Resolver:       &mockdns.Resolver{},
+		DownloadPolicy: mockDownloadPolicy(nil, errors.New("broken")),
+		Now:            func() time.Time { return now },
+	}
+	if err := c.Store.Store("example.org", "1234", now, cachedPolicy); err != nil {
+		t.Fatal(err)
+	}
+
+	// Record is gone but the cached policy is still valid.
+	now = now.Add(86399 * time.Second)
+	policy, err := c.Get(context.Background(), "example.org")
+	if err != nil {
+		t.Fatalf("policy get: %v", err)
+	}
+	if !reflect.DeepEqual(policy, cachedPolicy) {
+		t.Fatalf("wrong policy returned, want %+v, got %+v", cachedPolicy, policy)
+	}
+
+	now = now.Add(2 * time.Second)
+	_, err = c.Get(context.Background(), "example.org")
+	checkFetchError(t, err, FetchNoRecord)
+}
+
 func TestCacheGet_IDChange(t *testing.T) {
 	expectedPolicy := &Policy{
 		Mode:   ModeEnforce,
@@ -265,9 +357,7 @@ func TestCacheGet_HTTPGet_ErrNoPolicy(t *testing.T) {
 	// >cached policy, senders MUST continue with delivery as though the
 	// >domain has not implemented MTA-STS.
 	_, err := c.Get(context.Background(), "example.org")
-	if err != ErrNoPolicy {
-		t.Fatalf("policy get: %v", err)
-	}
+	checkFetchError(t, err, FetchDownloadFailed)
 }
 
 func TestCacheGet_IDChange_Error(t *testing.T) {
@@ -315,6 +405,54 @@ func TestCacheGet_IDChange_Error(t *testing.T) {
 	}
 }
 
+// failingStore is a Store that fails to save policies.
+type failingStore struct {
+	*ramStore
+}
+
+func (failingStore) Store(string, string, time.Time, *Policy) error {
+	return errors.New("broken")
+}
+
+func TestCacheGet_IDChange_StoreError(t *testing.T) {
+	t.Parallel()
+
+	cachedPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"a"},
+	}
+	newPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"b"},
+	}
+	store := newRAMStore()
+	if err := store.Store("example.org", "1234", time.Now(), cachedPolicy); err != nil {
+		t.Fatal(err)
+	}
+	c := Cache{
+		Store: failingStore{store},
+		Resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"_mta-sts.example.org.": {
+					TXT: []string{"v=STSv1; id=5678"},
+				},
+			},
+		},
+		DownloadPolicy: mockDownloadPolicy(newPolicy, nil),
+	}
+
+	// The downloaded policy should be used even if it cannot be cached.
+	policy, err := c.Get(context.Background(), "example.org")
+	if err != nil {
+		t.Fatalf("policy get: %v", err)
+	}
+	if !reflect.DeepEqual(policy, newPolicy) {
+		t.Fatalf("wrong policy returned, want %+v, got %+v", newPolicy, policy)
+	}
+}
+
 func TestCacheGet_IDChange_Expired_Error(t *testing.T) {
 	t.Parallel()
 
@@ -460,3 +598,382 @@ func TestCacheRefresh_Error(t *testing.T) {
 		t.Fatalf("wrong policy returned, want %+v, got %+v", expectedPolicy, policy)
 	}
 }
+
+type blockingResolver struct {
+	Resolver
+	block map[string]bool
+}
+
+func (r blockingResolver) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	if r.block[domain] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return r.Resolver.LookupTXT(ctx, domain)
+}
+
+func TestCacheRefreshContext(t *testing.T) {
+	t.Parallel()
+
+	cachedPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 60,
+		MX:     []string{"a"},
+	}
+	store := newRAMStore()
+	resolver := blockingResolver{
+		Resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"_mta-sts.a.example.org.": {
+					TXT: []string{"v=STSv1; id=1234"},
+				},
+				"_mta-sts.b.example.org.": {
+					TXT: []string{"v=STSv1; id=1234"},
+				},
+				"_mta-sts.c.example.org.": {
+					TXT: []string{"v=STSv1; id=1234"},
+				},
+			},
+		},
+		block: map[string]bool{"_mta-sts.slow.example.org": true},
+	}
+	c := Cache{
+		Store:              store,
+		Resolver:           resolver,
+		DownloadPolicy:     mockDownloadPolicy(cachedPolicy, nil),
+		RefreshConcurrency: 4,
+		RefreshTimeout:     100 * time.Millisecond,
+	}
+	for _, domain := range []string{"a.example.org", "b.example.org", "slow.example.org"} {
+		if err := store.Store(domain, "1234", time.Now().Add(-2*time.Minute), cachedPolicy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not going to expire soon.
+	if err := store.Store("c.example.org", "1234", time.Now(), &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400 * 7,
+		MX:     []string{"a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.RefreshContext(context.Background())
+	if err != nil {
+		t.Fatalf("cache refresh: %v", err)
+	}
+
+	if !reflect.DeepEqual(report.Refreshed, []string{"a.example.org", "b.example.org"}) {
+		t.Errorf("wrong refreshed list: %v", report.Refreshed)
+	}
+	if !reflect.DeepEqual(report.Unchanged, []string{"c.example.org"}) {
+		t.Errorf("wrong unchanged list: %v", report.Unchanged)
+	}
+	if len(report.Failed) != 1 || report.Failed["slow.example.org"] == nil {
+		t.Errorf("wrong failed list: %v", report.Failed)
+	}
+	if len(report.Skipped) != 0 {
+		t.Errorf("wrong skipped list: %v", report.Skipped)
+	}
+}
+
+func TestCacheRefreshContext_FailedWithValidCache(t *testing.T) {
+	t.Parallel()
+
+	cachedPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400 * 7,
+		MX:     []string{"a"},
+	}
+	store := newRAMStore()
+	c := Cache{
+		Store: store,
+		Resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				// ID changed, but the new policy cannot be downloaded.
+				"_mta-sts.a.example.org.": {
+					TXT: []string{"v=STSv1; id=5678"},
+				},
+				"_mta-sts.b.example.org.": {
+					TXT: []string{"v=STSv1; id=1234"},
+				},
+				"_mta-sts.c.example.org.": {
+					Err: &net.DNSError{Err: "timeout", IsTemporary: true},
+				},
+			},
+		},
+		DownloadPolicy: mockDownloadPolicy(nil, errors.New("broken")),
+	}
+	for _, domain := range []string{"a.example.org", "b.example.org", "c.example.org"} {
+		if err := store.Store(domain, "1234", time.Now(), cachedPolicy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := c.RefreshContext(context.Background())
+	if err != nil {
+		t.Fatalf("cache refresh: %v", err)
+	}
+
+	if !reflect.DeepEqual(report.Unchanged, []string{"b.example.org"}) {
+		t.Errorf("wrong unchanged list: %v", report.Unchanged)
+	}
+	if len(report.Failed) != 2 {
+		t.Errorf("wrong failed list: %v", report.Failed)
+	}
+	checkFetchError(t, report.Failed["a.example.org"], FetchDownloadFailed)
+	if report.Failed["c.example.org"] == nil {
+		t.Errorf("temporary DNS error not reported")
+	}
+
+	// Cached policy is still used.
+	policy, err := c.Get(context.Background(), "a.example.org")
+	if err != nil {
+		t.Fatalf("policy get: %v", err)
+	}
+	if !reflect.DeepEqual(policy, cachedPolicy) {
+		t.Fatalf("wrong policy returned, want %+v, got %+v", cachedPolicy, policy)
+	}
+}
+
+func TestCacheRefreshContext_Cancel(t *testing.T) {
+	c := Cache{
+		Store:          newRAMStore(),
+		Resolver:       &mockdns.Resolver{},
+		DownloadPolicy: mockDownloadPolicy(nil, errors.New("broken")),
+	}
+	for _, domain := range []string{"a.example.org", "b.example.org"} {
+		if err := c.Store.Store(domain, "1234", time.Now(), &Policy{Mode: ModeNone}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := c.RefreshContext(ctx)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if !reflect.DeepEqual(report.Skipped, []string{"a.example.org", "b.example.org"}) {
+		t.Errorf("wrong skipped list: %v", report.Skipped)
+	}
+}
+
+func TestCacheRefreshContext_Evict(t *testing.T) {
+	expiredPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 60,
+		MX:     []string{"a"},
+	}
+	c := Cache{
+		Store: newRAMStore(),
+		Resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"_mta-sts.published.example.org.": {
+					TXT: []string{"v=STSv1; id=1234"},
+				},
+			},
+		},
+		DownloadPolicy: mockDownloadPolicy(nil, errors.New("broken")),
+	}
+	for _, domain := range []string{"gone.example.org", "published.example.org"} {
+		if err := c.Store.Store(domain, "1234", time.Now().Add(-2*time.Minute), expiredPolicy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := c.RefreshContext(context.Background())
+	if err != nil {
+		t.Fatalf("cache refresh: %v", err)
+	}
+	if !reflect.DeepEqual(report.Evicted, []string{"gone.example.org"}) {
+		t.Errorf("wrong evicted list: %v", report.Evicted)
+	}
+	if len(report.Failed) != 1 || report.Failed["published.example.org"] == nil {
+		t.Errorf("wrong failed list: %v", report.Failed)
+	}
+
+	if _, _, _, err := c.Store.Load("gone.example.org"); err != ErrNoPolicy {
+		t.Errorf("evicted policy is still in store: %v", err)
+	}
+	if _, _, _, err := c.Store.Load("published.example.org"); err != nil {
+		t.Errorf("policy for the published domain was removed: %v", err)
+	}
+}
+
+// replacingStore simulates another Cache instance storing the new policy
+// right before the conditional deletion.
+type replacingStore struct {
+	*ramStore
+	fetchTime time.Time
+	policy    *Policy
+}
+
+func (s replacingStore) DeleteIfFetched(key string, fetchTime time.Time) (bool, error) {
+	if err := s.ramStore.Store(key, "5678", s.fetchTime, s.policy); err != nil {
+		return false, err
+	}
+	return s.ramStore.DeleteIfFetched(key, fetchTime)
+}
+
+func TestCacheRefreshContext_EvictReplaced(t *testing.T) {
+	expiredPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 60,
+		MX:     []string{"a"},
+	}
+	freshPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"b"},
+	}
+	store := replacingStore{ramStore: newRAMStore(), fetchTime: time.Now(), policy: freshPolicy}
+	c := Cache{
+		Store:          store,
+		Resolver:       &mockdns.Resolver{},
+		DownloadPolicy: mockDownloadPolicy(nil, errors.New("broken")),
+	}
+	if err := store.Store("example.org", "1234", time.Now().Add(-2*time.Minute), expiredPolicy); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.RefreshContext(context.Background())
+	if err != nil {
+		t.Fatalf("cache refresh: %v", err)
+	}
+	if len(report.Evicted) != 0 {
+		t.Errorf("wrong evicted list: %v", report.Evicted)
+	}
+	id, _, policy, err := store.Load("example.org")
+	if err != nil {
+		t.Fatalf("replaced policy was removed: %v", err)
+	}
+	if id != "5678" || !reflect.DeepEqual(policy, freshPolicy) {
+		t.Errorf("wrong policy in store: %v %+v", id, policy)
+	}
+}
+
+// testPolicyHost starts TLS server with the handler and returns the client
+// that directs all policy requests to it.
+//
+// httptest certificate is valid for *.example.com, so example.com and its
+// subdomains should be used as Policy Domains.
+func testPolicyHost(t *testing.T, h http.Handler) *http.Client {
+	t.Helper()
+	srv := httptest.NewTLSServer(h)
+	t.Cleanup(srv.Close)
+
+	client := srv.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	client.Transport = transport
+	return client
+}
+
+func TestDownloadPolicy(t *testing.T) {
+	expectedPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.com"},
+	}
+	published := true
+	client := testPolicyHost(t, PolicyHandler{
+		Lookup: func(domain string) (*Policy, error) {
+			if domain != "example.com" || !published {
+				return nil, ErrNoPolicy
+			}
+			return expectedPolicy, nil
+		},
+	})
+
+	c := Cache{HTTPClient: client}
+	policy, err := c.downloadPolicy(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("policy download: %v", err)
+	}
+	if !reflect.DeepEqual(policy, expectedPolicy) {
+		t.Fatalf("wrong policy returned, want %+v, got %+v", expectedPolicy, policy)
+	}
+
+	published = false
+	_, err = c.downloadPolicy(context.Background(), "example.com")
+	checkFetchError(t, err, FetchHTTPStatus)
+}
+
+func TestDownloadPolicy_Errors(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		reason  FetchErrorReason
+	}{
+		{
+			name: "redirect",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "https://mta-sts.example.com/policy.txt", http.StatusFound)
+			},
+			reason: FetchDownloadFailed,
+		},
+		{
+			name: "content type",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				io.WriteString(w, "version: STSv1\r\nmode: none\r\nmax_age: 86400\r\n")
+			},
+			reason: FetchContentType,
+		},
+		{
+			name: "malformed policy",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, "version: STSv1\r\nmode: enforce\r\nmax_age: 86400\r\n")
+			},
+			reason: FetchMalformedPolicy,
+		},
+		{
+			name: "charset",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-16")
+				io.WriteString(w, "version: STSv1\r\nmode: none\r\nmax_age: 86400\r\n")
+			},
+			reason: FetchCharset,
+		},
+		{
+			name: "content length",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Length", "2048")
+				io.WriteString(w, strings.Repeat("a", 2048))
+			},
+			reason: FetchPolicyTooLarge,
+		},
+		{
+			name: "chunked body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, "version: STSv1\r\nmode: none\r\nmax_age: 86400\r\n")
+				w.(http.Flusher).Flush()
+				for i := 0; i < 100; i++ {
+					io.WriteString(w, "mx: mx.example.com\r\n")
+				}
+			},
+			reason: FetchPolicyTooLarge,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := testPolicyHost(t, c.handler)
+			// CheckRedirect set by the caller should be ignored.
+			client.CheckRedirect = func(*http.Request, []*http.Request) error {
+				return nil
+			}
+
+			cache := Cache{HTTPClient: client, MaxPolicySize: 1024}
+			_, err := cache.downloadPolicy(context.Background(), "example.com")
+			checkFetchError(t, err, c.reason)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package mtasts
+
+import (
+	"context"
+	"time"
+)
+
+// fetchCall is an in-flight Cache.fetch shared by concurrent Cache.Get
+// calls.
+type fetchCall struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	// Protected by Cache.fetchesLock.
+	waiters int
+
+	// Set before done is closed.
+	policy *Policy
+	err    error
+}
+
+// detachedContext passes through values of the parent context, but not its
+// cancellation and deadline.
+//
+// It is used to run the shared fetch so cancellation of the caller that
+// started it does not affect other callers.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c *Cache) fetchShared(ctx context.Context, domain string) (*Policy, error) {
+	c.fetchesLock.Lock()
+	if c.fetches == nil {
+		c.fetches = make(map[string]*fetchCall)
+	}
+	call, ok := c.fetches[domain]
+	if !ok {
+		timeout := c.FetchTimeout
+		if timeout == 0 {
+			timeout = DefaultFetchTimeout
+		}
+		fetchCtx, cancel := context.WithTimeout(detachedContext{ctx}, timeout)
+		call = &fetchCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		c.fetches[domain] = call
+
+		go func() {
+			_, call.policy, call.err = c.fetch(fetchCtx, false, c.now(), domain)
+			if call.policy != nil {
+				// Fallback to the cached policy.
+				call.err = nil
+			}
+			cancel()
+
+			c.fetchesLock.Lock()
+			if c.fetches[domain] == call {
+				delete(c.fetches, domain)
+			}
+			c.fetchesLock.Unlock()
+
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	c.fetchesLock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.policy, call.err
+	case <-ctx.Done():
+		c.fetchesLock.Lock()
+		// Abort the fetch if nobody is interested in the result anymore.
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			if c.fetches[domain] == call {
+				delete(c.fetches, domain)
+			}
+		}
+		c.fetchesLock.Unlock()
+
+		if policy := c.loadValid(domain); policy != nil {
+			return policy, nil
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// loadValid returns the cached policy for the domain if it is not expired.
+func (c *Cache) loadValid(domain string) *Policy {
+	_, fetchTime, policy, err := c.Store.Load(domain)
+	if err != nil {
+		return nil
+	}
+	if fetchTime.Add(time.Duration(policy.MaxAge) * time.Second).Before(c.now()) {
+		return nil
+	}
+	return policy
+}
@@ -0,0 +1,158 @@
+package mtasts
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+)
+
+func waitFetchWaiters(t *testing.T, c *Cache, domain string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.fetchesLock.Lock()
+		call := c.fetches[domain]
+		waiters := 0
+		if call != nil {
+			waiters = call.waiters
+		}
+		c.fetchesLock.Unlock()
+		if waiters == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d waiters for %s", n, domain)
+}
+
+func TestCacheGet_Coalesce(t *testing.T) {
+	expectedPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 60,
+		MX:     []string{"a"},
+	}
+
+	var calls int32
+	release := make(chan struct{})
+	c := &Cache{
+		Store: newRAMStore(),
+		Resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"_mta-sts.example.org.": {
+					TXT: []string{"v=STSv1; id=1234"},
+				},
+			},
+		},
+		DownloadPolicy: func(string) (*Policy, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return expectedPolicy, nil
+		},
+	}
+
+	const getters = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, getters)
+	for i := 0; i < getters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			policy, err := c.Get(context.Background(), "example.org")
+			if err == nil && !reflect.DeepEqual(policy, expectedPolicy) {
+				t.Errorf("wrong policy returned, want %+v, got %+v", expectedPolicy, policy)
+			}
+			errs <- err
+		}()
+	}
+
+	// Cancellation of one waiter should not abort the fetch for others.
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := c.Get(cancelCtx, "example.org")
+		cancelled <- err
+	}()
+	waitFetchWaiters(t, c, "example.org", getters+1)
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("policy get: %v", err)
+		}
+	}
+
+	if calls != 1 {
+		t.Fatalf("expected a single download, got %d", calls)
+	}
+}
+
+func TestCacheGet_DeadlineCached(t *testing.T) {
+	cachedPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"a"},
+	}
+	c := &Cache{
+		Store: newRAMStore(),
+		Resolver: blockingResolver{
+			Resolver: &mockdns.Resolver{},
+			block:    map[string]bool{"_mta-sts.example.org": true, "_mta-sts.example.com": true},
+		},
+		DownloadPolicy: mockDownloadPolicy(nil, errors.New("broken")),
+	}
+	if err := c.Store.Store("example.org", "1234", time.Now(), cachedPolicy); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store.Store("example.com", "1234", time.Now().Add(-2*time.Minute), &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 60,
+		MX:     []string{"a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	policy, err := c.Get(ctx, "example.org")
+	if err != nil {
+		t.Fatalf("policy get: %v", err)
+	}
+	if !reflect.DeepEqual(policy, cachedPolicy) {
+		t.Fatalf("wrong policy returned, want %+v, got %+v", cachedPolicy, policy)
+	}
+
+	// Expired policy is not used.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, "example.com"); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestCacheGet_FetchTimeout(t *testing.T) {
+	c := &Cache{
+		Store: newRAMStore(),
+		Resolver: blockingResolver{
+			Resolver: &mockdns.Resolver{},
+			block:    map[string]bool{"_mta-sts.example.org": true},
+		},
+		FetchTimeout: 50 * time.Millisecond,
+	}
+
+	// Shared lookup is bounded even if the caller is not.
+	if _, err := c.Get(context.Background(), "example.org"); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
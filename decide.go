@@ -0,0 +1,125 @@
+package mtasts
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// Decision is the action the sender should take for the delivery attempt.
+type Decision int
+
+const (
+	// Proceed with the delivery.
+	DecisionDeliver Decision = iota + 1
+	// Proceed with the delivery, but report the policy failure (policy is
+	// in testing mode).
+	DecisionDeliverReport
+	// Do not deliver the message using this MX. Another MX should be tried
+	// or the delivery should be deferred.
+	DecisionDefer
+)
+
+func (d Decision) String() string {
+	switch d {
+	case DecisionDeliver:
+		return "deliver"
+	case DecisionDeliverReport:
+		return "deliver-report"
+	case DecisionDefer:
+		return "defer"
+	}
+	return fmt.Sprintf("Decision(%d)", int(d))
+}
+
+// TLSResult describes the outcome of the TLS negotiation with the MX.
+type TLSResult struct {
+	// State of the established TLS connection, nil if TLS was not
+	// negotiated.
+	State *tls.ConnectionState
+
+	// The error that prevented TLS negotiation, if any.
+	//
+	// If the handshake was aborted by the policy check done by the config
+	// returned by Policy.TLSConfig, Err contains the VerifyError that is
+	// then used as the failure reason.
+	Err error
+
+	// Set if TLS was not negotiated because the server does not offer
+	// STARTTLS, as opposed to the failed handshake.
+	NoSTARTTLS bool
+}
+
+// Outcome is the result of Decider.Decide.
+type Outcome struct {
+	Decision Decision
+
+	// Policy applied to the delivery, nil if the domain has no policy.
+	Policy *Policy
+
+	// Error returned by Cache.Get if the policy was not available.
+	FetchErr error
+
+	// Policy validation failure, always a VerifyError. Set if Decision is
+	// DecisionDeliverReport or DecisionDefer.
+	Failure error
+}
+
+// Decider implements the policy application logic described in RFC 8461,
+// Section 5.
+type Decider struct {
+	Cache *Cache
+
+	// CAs trusted for the MX certificates. If nil, system roots are used.
+	Roots *x509.CertPool
+}
+
+// Decide determines whether the message for domain can be delivered to mx
+// given the result of TLS negotiation with it.
+//
+// The domain is assumed to be normalized, as done by dns.ForLookup.
+//
+// If the policy cannot be fetched, the delivery proceeds as though the
+// domain does not implement MTA-STS. The error is returned only if ctx is
+// cancelled.
+func (d Decider) Decide(ctx context.Context, domain, mx string, res TLSResult) (Outcome, error) {
+	policy, err := d.Cache.Get(ctx, domain)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Outcome{}, ctx.Err()
+		}
+		return Outcome{Decision: DecisionDeliver, FetchErr: err}, nil
+	}
+
+	out := Outcome{Decision: DecisionDeliver, Policy: policy}
+	if policy.Mode == ModeNone {
+		return out, nil
+	}
+
+	if res.State == nil {
+		var verr VerifyError
+		if errors.As(res.Err, &verr) {
+			out.Failure = verr
+		} else {
+			reason := VerifyTLSFailed
+			if res.NoSTARTTLS {
+				reason = VerifyNoSTARTTLS
+			}
+			out.Failure = VerifyError{Reason: reason, MX: mx, Err: res.Err}
+		}
+	} else {
+		out.Failure = policy.VerifyConnection(mx, d.Roots)(*res.State)
+	}
+	if out.Failure == nil {
+		return out, nil
+	}
+
+	if policy.Mode == ModeTesting {
+		out.Decision = DecisionDeliverReport
+	} else {
+		out.Decision = DecisionDefer
+	}
+	return out, nil
+}
@@ -0,0 +1,176 @@
+package mtasts
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+)
+
+func TestDeciderDecide(t *testing.T) {
+	ca := newTestCA(t)
+	validState := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{
+			ca.issue(t, "", []string{"mx.example.org"}, time.Now().Add(time.Hour)),
+		},
+	}
+	invalidState := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{
+			ca.issue(t, "", []string{"other.example.org"}, time.Now().Add(time.Hour)),
+		},
+	}
+
+	cases := []struct {
+		name     string
+		policy   *Policy
+		res      TLSResult
+		decision Decision
+		reason   VerifyErrorReason
+	}{
+		{
+			name:     "no policy",
+			res:      TLSResult{Err: errors.New("STARTTLS not supported")},
+			decision: DecisionDeliver,
+		},
+		{
+			name:     "none",
+			policy:   &Policy{Mode: ModeNone, MaxAge: 86400},
+			res:      TLSResult{Err: errors.New("STARTTLS not supported")},
+			decision: DecisionDeliver,
+		},
+		{
+			name:     "enforce valid",
+			policy:   &Policy{Mode: ModeEnforce, MaxAge: 86400, MX: []string{"mx.example.org"}},
+			res:      TLSResult{State: validState},
+			decision: DecisionDeliver,
+		},
+		{
+			name:     "enforce invalid",
+			policy:   &Policy{Mode: ModeEnforce, MaxAge: 86400, MX: []string{"mx.example.org"}},
+			res:      TLSResult{State: invalidState},
+			decision: DecisionDefer,
+			reason:   VerifyHostMismatch,
+		},
+		{
+			name:     "enforce no STARTTLS",
+			policy:   &Policy{Mode: ModeEnforce, MaxAge: 86400, MX: []string{"mx.example.org"}},
+			res:      TLSResult{Err: errors.New("STARTTLS not supported"), NoSTARTTLS: true},
+			decision: DecisionDefer,
+			reason:   VerifyNoSTARTTLS,
+		},
+		{
+			name:     "enforce handshake failed",
+			policy:   &Policy{Mode: ModeEnforce, MaxAge: 86400, MX: []string{"mx.example.org"}},
+			res:      TLSResult{Err: errors.New("remote error: tls: handshake failure")},
+			decision: DecisionDefer,
+			reason:   VerifyTLSFailed,
+		},
+		{
+			name:     "testing invalid",
+			policy:   &Policy{Mode: ModeTesting, MaxAge: 86400, MX: []string{"mx.example.org"}},
+			res:      TLSResult{State: invalidState},
+			decision: DecisionDeliverReport,
+			reason:   VerifyHostMismatch,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			zones := map[string]mockdns.Zone{}
+			if c.policy != nil {
+				zones["_mta-sts.example.org."] = mockdns.Zone{
+					TXT: []string{"v=STSv1; id=1234"},
+				}
+			}
+			d := Decider{
+				Cache: &Cache{
+					Store:          newRAMStore(),
+					Resolver:       &mockdns.Resolver{Zones: zones},
+					DownloadPolicy: mockDownloadPolicy(c.policy, nil),
+				},
+				Roots: ca.pool,
+			}
+
+			out, err := d.Decide(context.Background(), "example.org", "mx.example.org", c.res)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out.Decision != c.decision {
+				t.Errorf("wrong decision, want %v, got %v", c.decision, out.Decision)
+			}
+			if c.policy == nil && !IsNoPolicy(out.FetchErr) {
+				t.Errorf("expected no policy error, got %v", out.FetchErr)
+			}
+			if c.reason == 0 {
+				if out.Failure != nil {
+					t.Errorf("unexpected failure: %v", out.Failure)
+				}
+				return
+			}
+			verr, ok := out.Failure.(VerifyError)
+			if !ok || verr.Reason != c.reason {
+				t.Errorf("wrong failure, want %v, got %v", c.reason, out.Failure)
+			}
+		})
+	}
+}
+
+func TestDeciderDecide_TLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+	cert, key := ca.issueKeyPair(t, "", []string{"other.example.org"}, time.Now().Add(time.Hour))
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte{'a'})
+			conn.Close()
+		}
+	}()
+
+	policy := &Policy{Mode: ModeEnforce, MaxAge: 86400, MX: []string{"mx.example.org"}}
+	d := Decider{
+		Cache: &Cache{
+			Store: newRAMStore(),
+			Resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+				"_mta-sts.example.org.": {
+					TXT: []string{"v=STSv1; id=1234"},
+				},
+			}},
+			DownloadPolicy: mockDownloadPolicy(policy, nil),
+		},
+		Roots: ca.pool,
+	}
+
+	cfg := policy.TLSConfig("mx.example.org", &tls.Config{RootCAs: ca.pool})
+	conn, err := tls.Dial("tcp", l.Addr().String(), cfg)
+	if err == nil {
+		conn.Close()
+		t.Fatal("handshake succeeded")
+	}
+
+	out, err := d.Decide(context.Background(), "example.org", "mx.example.org", TLSResult{Err: err})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Decision != DecisionDefer {
+		t.Errorf("wrong decision, want %v, got %v", DecisionDefer, out.Decision)
+	}
+	verr, ok := out.Failure.(VerifyError)
+	if !ok || verr.Reason != VerifyHostMismatch {
+		t.Errorf("wrong failure, want %v, got %v", VerifyHostMismatch, out.Failure)
+	}
+}
@@ -0,0 +1,78 @@
+package mtasts
+
+import (
+	"fmt"
+)
+
+// FetchErrorReason describes why the policy for a domain was not applied.
+type FetchErrorReason int
+
+const (
+	// The domain does not publish the _mta-sts TXT record.
+	FetchNoRecord FetchErrorReason = iota + 1
+	// The domain publishes more than one _mta-sts TXT record.
+	FetchMultipleRecords
+	// The _mta-sts TXT record is syntactically invalid.
+	FetchMalformedRecord
+	// The policy cannot be downloaded due to a network or TLS error.
+	FetchDownloadFailed
+	// The Policy Host responded with a status other than 200.
+	FetchHTTPStatus
+	// The Policy Host responded with a Content-Type other than text/plain.
+	FetchContentType
+	// The policy text is syntactically invalid.
+	FetchMalformedPolicy
+	// The policy text is larger than Cache.MaxPolicySize.
+	FetchPolicyTooLarge
+	// The Policy Host specified a charset other than US-ASCII or UTF-8.
+	FetchCharset
+)
+
+func (r FetchErrorReason) String() string {
+	switch r {
+	case FetchNoRecord:
+		return "no TXT record"
+	case FetchMultipleRecords:
+		return "multiple TXT records"
+	case FetchMalformedRecord:
+		return "malformed TXT record"
+	case FetchDownloadFailed:
+		return "download failed"
+	case FetchHTTPStatus:
+		return "unexpected HTTP status"
+	case FetchContentType:
+		return "unexpected content type"
+	case FetchMalformedPolicy:
+		return "malformed policy"
+	case FetchPolicyTooLarge:
+		return "policy too large"
+	case FetchCharset:
+		return "unsupported charset"
+	}
+	return fmt.Sprintf("FetchErrorReason(%d)", int(r))
+}
+
+// FetchError is returned by Cache.Get when the domain has no usable policy.
+//
+// IsNoPolicy returns true for all FetchError values.
+type FetchError struct {
+	Reason FetchErrorReason
+	Domain string
+	Err    error
+}
+
+func (e FetchError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("mtasts: no policy for %s: %v", e.Domain, e.Reason)
+	}
+	return fmt.Sprintf("mtasts: no policy for %s: %v: %v", e.Domain, e.Reason, e.Err)
+}
+
+func (e FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrNoPolicy) return true for FetchError.
+func (e FetchError) Is(target error) bool {
+	return target == ErrNoPolicy
+}
@@ -0,0 +1,22 @@
+//+build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package mtasts
+
+import (
+	"sync"
+)
+
+// On platforms without flock, only goroutines of the same process are
+// synchronized.
+var fsLocks sync.Map
+
+func lockFile(path string, exclusive bool) (unlock func(), err error) {
+	l, _ := fsLocks.LoadOrStore(path, &sync.RWMutex{})
+	lock := l.(*sync.RWMutex)
+	if exclusive {
+		lock.Lock()
+		return lock.Unlock, nil
+	}
+	lock.RLock()
+	return lock.RUnlock, nil
+}
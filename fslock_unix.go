@@ -0,0 +1,40 @@
+//+build linux darwin freebsd netbsd openbsd dragonfly
+
+package mtasts
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an advisory lock on the file at path, creating it if
+// necessary.
+//
+// The lock is shared between readers and exclusive for writers, both for
+// other processes and for other goroutines of the same process.
+func lockFile(path string, exclusive bool) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -2,10 +2,16 @@ module github.com/foxcpp/go-mtasts
 
 require (
 	github.com/foxcpp/go-mockdns v0.0.0-20191216195825-5eabd8dbfe1f
-	github.com/miekg/dns v1.1.25 // indirect
+	github.com/mattn/go-sqlite3 v1.14.16
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/crypto v0.18.0
 	golang.org/x/net v0.20.0
 	golang.org/x/text v0.14.0
 )
 
-go 1.13
+require (
+	github.com/miekg/dns v1.1.25 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+)
+
+go 1.17
@@ -0,0 +1,74 @@
+package mtasts
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// WellKnownPath is the path the policy is served from on the Policy Host.
+const WellKnownPath = "/.well-known/mta-sts.txt"
+
+// PolicyHandler implements http.Handler that serves policies for
+// mta-sts.<domain> Policy Hosts.
+//
+// The Policy Domain is derived from the Host header. Requests for any other
+// path or for hosts without the "mta-sts." prefix get 404 response.
+// Redirects are never issued since RFC 8461 forbids senders from following
+// them.
+type PolicyHandler struct {
+	// Lookup is called to get the policy for the Policy Domain. The domain
+	// is normalized as done by dns.ForLookup.
+	//
+	// If ErrNoPolicy is returned, the handler responds with 404. Any other
+	// error results in 500.
+	Lookup func(domain string) (*Policy, error)
+}
+
+func (h PolicyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != WellKnownPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host, err := forLookup(host)
+	if err != nil || !strings.HasPrefix(host, "mta-sts.") {
+		http.NotFound(w, r)
+		return
+	}
+	domain := strings.TrimPrefix(host, "mta-sts.")
+
+	policy, err := h.Lookup(domain)
+	if err != nil {
+		if IsNoPolicy(err) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if _, err := policy.WriteTo(&buf); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(buf.Bytes())
+	}
+}
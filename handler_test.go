@@ -0,0 +1,74 @@
+package mtasts
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPolicyHandler(t *testing.T) {
+	expectedPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.org"},
+	}
+	h := PolicyHandler{
+		Lookup: func(domain string) (*Policy, error) {
+			switch domain {
+			case "example.org":
+				return expectedPolicy, nil
+			case "broken.example.org":
+				return &Policy{Mode: ModeEnforce}, nil
+			case "error.example.org":
+				return nil, errors.New("broken")
+			}
+			return nil, ErrNoPolicy
+		},
+	}
+
+	cases := []struct {
+		method string
+		host   string
+		path   string
+		status int
+	}{
+		{method: "GET", host: "mta-sts.example.org", path: WellKnownPath, status: 200},
+		{method: "GET", host: "MTA-STS.Example.org.:443", path: WellKnownPath, status: 200},
+		{method: "HEAD", host: "mta-sts.example.org", path: WellKnownPath, status: 200},
+		{method: "POST", host: "mta-sts.example.org", path: WellKnownPath, status: 405},
+		{method: "GET", host: "mta-sts.example.org", path: "/", status: 404},
+		{method: "GET", host: "example.org", path: WellKnownPath, status: 404},
+		{method: "GET", host: "mta-sts.unknown.org", path: WellKnownPath, status: 404},
+		{method: "GET", host: "mta-sts.broken.example.org", path: WellKnownPath, status: 500},
+		{method: "GET", host: "mta-sts.error.example.org", path: WellKnownPath, status: 500},
+	}
+
+	for _, c := range cases {
+		t.Run(c.method+" "+c.host+c.path, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, "https://"+c.host+c.path, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			resp := rec.Result()
+			if resp.StatusCode != c.status {
+				t.Fatalf("wrong status, want %v, got %v", c.status, resp.StatusCode)
+			}
+			if c.status != http.StatusOK || c.method != "GET" {
+				return
+			}
+
+			if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+				t.Fatalf("wrong Content-Type: %v", ct)
+			}
+			policy, err := readPolicy(resp.Body)
+			if err != nil {
+				t.Fatalf("served policy is not readable: %v", err)
+			}
+			if !reflect.DeepEqual(policy, expectedPolicy) {
+				t.Fatalf("wrong policy served, want %+v, got %+v", expectedPolicy, policy)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package mtasts
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// LRUStats contains eviction counters of LRUStore.
+type LRUStats struct {
+	// Number of entries currently stored.
+	Entries int
+
+	// Total number of entries evicted to stay within the limit.
+	Evicted uint64
+
+	// Number of evicted entries that contained a still valid policy in
+	// enforce mode. Non-zero value means the limit is too low and some
+	// domains lost downgrade protection.
+	EvictedEnforce uint64
+}
+
+type lruEntry struct {
+	key       string
+	id        string
+	fetchTime time.Time
+	policy    *Policy
+	enforce   bool
+}
+
+// LRUStore is the in-memory Store implementation with the limit on the amount
+// of stored entries.
+//
+// When the limit is reached, the least recently used entry is evicted. Entries
+// with a still valid policy in enforce mode are evicted only if there are no
+// other entries (policies in none or testing mode or expired ones).
+//
+// LRUStore is goroutine-safe.
+type LRUStore struct {
+	// If non-nil, replaces time.Now as the source of the current time used
+	// to check whether enforce policies are expired during eviction.
+	//
+	// It is not inherited from Cache.Now and should be set to the same
+	// function, otherwise valid policies can be evicted as expired ones or
+	// vice versa.
+	Now func() time.Time
+
+	maxEntries int
+
+	lock    sync.Mutex
+	m       map[string]*list.Element
+	weak    *list.List
+	enforce *list.List
+	stats   LRUStats
+}
+
+// NewLRUStore creates the LRUStore that keeps at most maxEntries policies.
+//
+// If maxEntries is zero or negative, the amount is not limited.
+func NewLRUStore(maxEntries int) *LRUStore {
+	return &LRUStore{
+		maxEntries: maxEntries,
+		m:          make(map[string]*list.Element),
+		weak:       list.New(),
+		enforce:    list.New(),
+	}
+}
+
+func (s *LRUStore) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// Stats returns the current values of eviction counters.
+func (s *LRUStore) Stats() LRUStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := s.stats
+	stats.Entries = len(s.m)
+	return stats
+}
+
+func (s *LRUStore) listFor(e *lruEntry) *list.List {
+	if e.enforce {
+		return s.enforce
+	}
+	return s.weak
+}
+
+func (s *LRUStore) List() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keys := make([]string, 0, len(s.m))
+	for k := range s.m {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (s *LRUStore) Store(key string, id string, fetchTime time.Time, policy *Policy) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry := &lruEntry{
+		key:       key,
+		id:        id,
+		fetchTime: fetchTime,
+		policy:    policy,
+		enforce:   policy != nil && policy.Mode == ModeEnforce,
+	}
+
+	if el, ok := s.m[key]; ok {
+		old := el.Value.(*lruEntry)
+		s.listFor(old).Remove(el)
+	}
+	s.m[key] = s.listFor(entry).PushFront(entry)
+
+	if s.maxEntries > 0 {
+		for len(s.m) > s.maxEntries {
+			s.evict(s.now())
+		}
+	}
+	return nil
+}
+
+// evict removes one entry, preferring the least recently used entry without
+// a valid enforce policy.
+func (s *LRUStore) evict(now time.Time) {
+	el := s.weak.Back()
+	if el == nil {
+		// Look for expired enforce policies before giving up on a valid one.
+		for cur := s.enforce.Back(); cur != nil; cur = cur.Prev() {
+			e := cur.Value.(*lruEntry)
+			if e.fetchTime.Add(time.Duration(e.policy.MaxAge) * time.Second).Before(now) {
+				el = cur
+				break
+			}
+		}
+	}
+	if el == nil {
+		el = s.enforce.Back()
+		s.stats.EvictedEnforce++
+	}
+
+	e := el.Value.(*lruEntry)
+	s.listFor(e).Remove(el)
+	delete(s.m, e.key)
+	s.stats.Evicted++
+}
+
+func (s *LRUStore) Load(key string) (id string, fetchTime time.Time, policy *Policy, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	el, ok := s.m[key]
+	if !ok {
+		return "", time.Time{}, nil, ErrNoPolicy
+	}
+	e := el.Value.(*lruEntry)
+	s.listFor(e).MoveToFront(el)
+	return e.id, e.fetchTime, e.policy, nil
+}
+
+func (s *LRUStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	el, ok := s.m[key]
+	if !ok {
+		return nil
+	}
+	s.listFor(el.Value.(*lruEntry)).Remove(el)
+	delete(s.m, key)
+	return nil
+}
+
+func (s *LRUStore) DeleteIfFetched(key string, fetchTime time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	el, ok := s.m[key]
+	if !ok {
+		return false, nil
+	}
+	e := el.Value.(*lruEntry)
+	if !e.fetchTime.Equal(fetchTime) {
+		return false, nil
+	}
+	s.listFor(e).Remove(el)
+	delete(s.m, key)
+	return true, nil
+}
+
+// NewLRUCache creates the Cache object using LRUStore with the specified
+// limit to store cached policies.
+//
+// Use Cache.Store.(*LRUStore).Stats() to get eviction counters.
+func NewLRUCache(maxEntries int) *Cache {
+	return &Cache{
+		Store:    NewLRUStore(maxEntries),
+		Resolver: net.DefaultResolver,
+	}
+}
@@ -0,0 +1,127 @@
+package mtasts
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLRUStore(t *testing.T) {
+	enforcePolicy := &Policy{Mode: ModeEnforce, MaxAge: 86400, MX: []string{"mx.example.org"}}
+	testingPolicy := &Policy{Mode: ModeTesting, MaxAge: 86400, MX: []string{"mx.example.org"}}
+	nonePolicy := &Policy{Mode: ModeNone, MaxAge: 86400}
+
+	now := time.Now()
+	expired := now.Add(-48 * time.Hour)
+
+	type entry struct {
+		domain    string
+		fetchTime time.Time
+		policy    *Policy
+	}
+	test := func(name string, max int, entries []entry, load []string, expectKeys []string, expectStats LRUStats) {
+		t.Helper()
+		t.Run(name, func(t *testing.T) {
+			s := NewLRUStore(max)
+			for _, e := range entries {
+				if err := s.Store(e.domain, "1", e.fetchTime, e.policy); err != nil {
+					t.Fatal(err)
+				}
+				for _, l := range load {
+					if l == e.domain {
+						continue
+					}
+					_, _, _, _ = s.Load(l)
+				}
+			}
+
+			keys, err := s.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, expectKeys) {
+				t.Errorf("wrong keys: want %v, got %v", expectKeys, keys)
+			}
+			if stats := s.Stats(); stats != expectStats {
+				t.Errorf("wrong stats: want %+v, got %+v", expectStats, stats)
+			}
+		})
+	}
+
+	test("unlimited", 0, []entry{
+		{"a.example", now, nonePolicy},
+		{"b.example", now, testingPolicy},
+		{"c.example", now, enforcePolicy},
+	}, nil, []string{"a.example", "b.example", "c.example"}, LRUStats{Entries: 3})
+	test("lru order", 2, []entry{
+		{"a.example", now, nonePolicy},
+		{"b.example", now, nonePolicy},
+		{"c.example", now, nonePolicy},
+	}, []string{"a.example"}, []string{"a.example", "c.example"}, LRUStats{Entries: 2, Evicted: 1})
+	test("enforce kept", 2, []entry{
+		{"a.example", now, enforcePolicy},
+		{"b.example", now, testingPolicy},
+		{"c.example", now, nonePolicy},
+	}, nil, []string{"a.example", "c.example"}, LRUStats{Entries: 2, Evicted: 1})
+	test("expired enforce evicted first", 2, []entry{
+		{"a.example", now, enforcePolicy},
+		{"b.example", expired, enforcePolicy},
+		{"c.example", now, enforcePolicy},
+	}, nil, []string{"a.example", "c.example"}, LRUStats{Entries: 2, Evicted: 1})
+	test("enforce evicted as last resort", 2, []entry{
+		{"a.example", now, enforcePolicy},
+		{"b.example", now, enforcePolicy},
+		{"c.example", now, enforcePolicy},
+	}, nil, []string{"b.example", "c.example"}, LRUStats{Entries: 2, Evicted: 1, EvictedEnforce: 1})
+}
+
+func TestLRUStore_Clock(t *testing.T) {
+	policy := &Policy{Mode: ModeEnforce, MaxAge: 86400, MX: []string{"mx.example.org"}}
+	fetchTime := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	s := NewLRUStore(2)
+	s.Now = func() time.Time { return fetchTime.Add(time.Hour) }
+	for _, domain := range []string{"a.example", "b.example", "c.example"} {
+		if err := s.Store(domain, "1", fetchTime, policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Policies are still valid according to Now, so the valid enforce
+	// policy had to be evicted.
+	expectStats := LRUStats{Entries: 2, Evicted: 1, EvictedEnforce: 1}
+	if stats := s.Stats(); stats != expectStats {
+		t.Errorf("wrong stats: want %+v, got %+v", expectStats, stats)
+	}
+}
+
+func TestLRUStore_Update(t *testing.T) {
+	s := NewLRUStore(1)
+	policy := &Policy{Mode: ModeEnforce, MaxAge: 86400, MX: []string{"mx.example.org"}}
+
+	if err := s.Store("example.org", "1", time.Now(), policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store("example.org", "2", time.Now(), &Policy{Mode: ModeNone, MaxAge: 86400}); err != nil {
+		t.Fatal(err)
+	}
+	id, _, loaded, err := s.Load("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "2" || loaded.Mode != ModeNone {
+		t.Errorf("stale entry loaded: %v %+v", id, loaded)
+	}
+	if stats := s.Stats(); stats != (LRUStats{Entries: 1}) {
+		t.Errorf("wrong stats: %+v", stats)
+	}
+
+	if err := s.Delete("example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.Load("example.org"); err != ErrNoPolicy {
+		t.Errorf("expected ErrNoPolicy, got %v", err)
+	}
+}
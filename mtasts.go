@@ -19,10 +19,96 @@ func (e MalformedDNSRecordError) Error() string {
 	return fmt.Sprintf("mtasts: malformed DNS record: %s", e.Desc)
 }
 
-func readDNSRecord(raw string) (id string, err error) {
+// DNSRecordExtension is a single extension key-value pair from the MTA-STS TXT
+// record.
+type DNSRecordExtension struct {
+	Key   string
+	Value string
+}
+
+// DNSRecord is the parsed form of the _mta-sts TXT record (RFC 8461, Section
+// 3.1).
+type DNSRecord struct {
+	// Version of the record, always "STSv1" for records returned by
+	// ParseDNSRecord. Empty value is treated as "STSv1" by String.
+	Version string
+
+	// Policy ID, 1 to 32 alphanumeric characters.
+	ID string
+
+	// Extension fields in the order they appear in the record.
+	Extensions []DNSRecordExtension
+}
+
+// String returns the record in the TXT record value format.
+func (r DNSRecord) String() string {
+	version := r.Version
+	if version == "" {
+		version = "STSv1"
+	}
+
+	var b strings.Builder
+	b.WriteString("v=" + version + "; id=" + r.ID)
+	for _, ext := range r.Extensions {
+		b.WriteString("; " + ext.Key + "=" + ext.Value)
+	}
+	return b.String()
+}
+
+func isAlnum(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+func validID(id string) bool {
+	if len(id) == 0 || len(id) > 32 {
+		return false
+	}
+	for _, r := range id {
+		if !isAlnum(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func validExtName(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for i, r := range name {
+		if isAlnum(r) {
+			continue
+		}
+		if i != 0 && (r == '_' || r == '-' || r == '.') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func validExtValue(value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for _, r := range value {
+		// sts-ext-value = 1*(%x21-3A / %x3C / %x3E-7E)
+		if r < 0x21 || r > 0x7E || r == ';' || r == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseDNSRecord parses the value of the _mta-sts TXT record.
+//
+// Unlike the policy ID, extension fields are not interpreted and returned
+// as is.
+func ParseDNSRecord(raw string) (*DNSRecord, error) {
 	parts := strings.Split(raw, ";")
+	rec := DNSRecord{}
 	versionPresent := false
-	for _, part := range parts {
+	for i, part := range parts {
 		part = strings.TrimSpace(part)
 		// handle k=v;k=v;
 		//				 ^
@@ -31,30 +117,53 @@ func readDNSRecord(raw string) (id string, err error) {
 		}
 		kv := strings.Split(part, "=")
 		if len(kv) != 2 {
-			return "", MalformedDNSRecordError{Desc: "invalid record part: " + part}
+			return nil, MalformedDNSRecordError{Desc: "invalid record part: " + part}
 		}
 
 		if strings.ContainsAny(kv[0], " \t") || strings.ContainsAny(kv[1], " \t") {
-			return "", MalformedDNSRecordError{Desc: "whitespace is not allowed in name or value"}
+			return nil, MalformedDNSRecordError{Desc: "whitespace is not allowed in name or value"}
 		}
 
 		switch kv[0] {
 		case "v":
+			if i != 0 {
+				return nil, MalformedDNSRecordError{Desc: "version must be the first field"}
+			}
 			if kv[1] != "STSv1" {
-				return "", MalformedDNSRecordError{Desc: "unsupported version: " + kv[1]}
+				return nil, MalformedDNSRecordError{Desc: "unsupported version: " + kv[1]}
 			}
+			rec.Version = kv[1]
 			versionPresent = true
 		case "id":
-			id = kv[1]
+			if !validID(kv[1]) {
+				return nil, MalformedDNSRecordError{Desc: "invalid id value: " + kv[1]}
+			}
+			rec.ID = kv[1]
+		default:
+			if !validExtName(kv[0]) {
+				return nil, MalformedDNSRecordError{Desc: "invalid extension name: " + kv[0]}
+			}
+			if !validExtValue(kv[1]) {
+				return nil, MalformedDNSRecordError{Desc: "invalid extension value: " + kv[1]}
+			}
+			rec.Extensions = append(rec.Extensions, DNSRecordExtension{Key: kv[0], Value: kv[1]})
 		}
 	}
 	if !versionPresent {
-		return "", MalformedDNSRecordError{Desc: "missing version value"}
+		return nil, MalformedDNSRecordError{Desc: "missing version value"}
+	}
+	if rec.ID == "" {
+		return nil, MalformedDNSRecordError{Desc: "missing id value"}
 	}
-	if id == "" {
-		return "", MalformedDNSRecordError{Desc: "missing id value"}
+	return &rec, nil
+}
+
+func readDNSRecord(raw string) (id string, err error) {
+	rec, err := ParseDNSRecord(raw)
+	if err != nil {
+		return "", err
 	}
-	return
+	return rec.ID, nil
 }
 
 type MalformedPolicyError struct {
@@ -80,6 +189,13 @@ type Policy struct {
 	MX     []string
 }
 
+// ParsePolicy reads the MTA-STS policy text as served by the Policy Host.
+//
+// Both LF and CRLF line endings are accepted.
+func ParsePolicy(contents io.Reader) (*Policy, error) {
+	return readPolicy(contents)
+}
+
 func readPolicy(contents io.Reader) (*Policy, error) {
 	scnr := bufio.NewScanner(contents)
 	policy := Policy{}
@@ -140,6 +256,86 @@ func readPolicy(contents io.Reader) (*Policy, error) {
 	return &policy, nil
 }
 
+// maxMaxAge is the upper limit for max_age value defined by RFC 8461.
+const maxMaxAge = 31557600
+
+// validMXPattern checks whether mx matches the sts-policy-mx-value grammar
+// from RFC 8461, i.e. it is a domain name optionally prefixed with "*.".
+func validMXPattern(mx string) bool {
+	mx = strings.TrimPrefix(mx, "*.")
+	if mx == "" || len(mx) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(mx, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		// sub-domain = Let-dig [Ldh-str]
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !isAlnum(r) && r != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Validate checks whether the policy conforms to RFC 8461 and can be
+// serialized using WriteTo.
+//
+// It is stricter than ParsePolicy: max_age should be in the range defined by
+// RFC 8461 and mx values should be valid host name patterns.
+func (p Policy) Validate() error {
+	switch p.Mode {
+	case ModeEnforce, ModeTesting, ModeNone:
+	default:
+		return MalformedPolicyError{Desc: "invalid mode value: " + string(p.Mode)}
+	}
+	if p.MaxAge < 0 || p.MaxAge > maxMaxAge {
+		return MalformedPolicyError{Desc: "max_age value out of range: " + strconv.Itoa(p.MaxAge)}
+	}
+	if p.Mode != ModeNone && len(p.MX) == 0 {
+		return MalformedPolicyError{Desc: "at least one mx field required when mode is not none"}
+	}
+	for _, mx := range p.MX {
+		if !validMXPattern(mx) {
+			return MalformedPolicyError{Desc: "invalid mx value: " + strconv.Quote(mx)}
+		}
+	}
+	return nil
+}
+
+// WriteTo writes the policy text in the format defined by RFC 8461 to w.
+//
+// Lines are terminated using CRLF. The policy is validated using Validate
+// before anything is written.
+func (p Policy) WriteTo(w io.Writer) (int64, error) {
+	if err := p.Validate(); err != nil {
+		return 0, err
+	}
+	return writePolicy(w, p)
+}
+
+// writePolicy writes the policy text without validation.
+//
+// It is used for policies returned by ParsePolicy that do not necessarily
+// pass Validate, the output is not guaranteed to be parseable otherwise.
+func writePolicy(w io.Writer, p Policy) (int64, error) {
+	var b strings.Builder
+	b.WriteString("version: STSv1\r\n")
+	b.WriteString("mode: " + string(p.Mode) + "\r\n")
+	for _, mx := range p.MX {
+		b.WriteString("mx: " + mx + "\r\n")
+	}
+	b.WriteString("max_age: " + strconv.Itoa(p.MaxAge) + "\r\n")
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
 func (p Policy) Match(mx string) bool {
 	normMX, err := forLookup(mx)
 	if err != nil {
@@ -45,6 +45,22 @@ func TestReadDNSRecord(t *testing.T) {
 			value: "v=STSv1;    id=foo include",
 			fail:  true,
 		},
+		{
+			value: "id=foo; v=STSv1",
+			fail:  true,
+		},
+		{
+			value: "v=STSv1; id=foo-bar",
+			fail:  true,
+		},
+		{
+			value: "v=STSv1; id=012345678901234567890123456789012",
+			fail:  true,
+		},
+		{
+			value: "v=STSv1; id=foo; _ext=1",
+			fail:  true,
+		},
 		{
 			value: "v=STSv1  ;    id=foo",
 			id:    "foo",
@@ -76,6 +92,29 @@ func TestReadDNSRecord(t *testing.T) {
 	}
 }
 
+func TestParseDNSRecord(t *testing.T) {
+	rec, err := ParseDNSRecord("v=STSv1; id=20190429T010101; ext-1=a; ext.2=b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &DNSRecord{
+		Version: "STSv1",
+		ID:      "20190429T010101",
+		Extensions: []DNSRecordExtension{
+			{Key: "ext-1", Value: "a"},
+			{Key: "ext.2", Value: "b/c"},
+		},
+	}
+	if !reflect.DeepEqual(rec, expected) {
+		t.Fatalf("wrong record, want %+v, got %+v", expected, rec)
+	}
+
+	const text = "v=STSv1; id=20190429T010101; ext-1=a; ext.2=b/c"
+	if rec.String() != text {
+		t.Fatalf("wrong String output, want %q, got %q", text, rec.String())
+	}
+}
+
 func TestReadPolicy(t *testing.T) {
 	cases := []struct {
 		value  string
@@ -271,3 +310,116 @@ func TestPolicyMatch(t *testing.T) {
 		})
 	}
 }
+
+func TestPolicyWriteTo(t *testing.T) {
+	cases := []struct {
+		policy Policy
+		text   string
+		fail   bool
+	}{
+		{
+			policy: Policy{Mode: ModeNone, MaxAge: 8600},
+			text:   "version: STSv1\r\nmode: none\r\nmax_age: 8600\r\n",
+		},
+		{
+			policy: Policy{
+				Mode:   ModeEnforce,
+				MaxAge: 604800,
+				MX:     []string{"mx0.example.org", "*.example.org"},
+			},
+			text: "version: STSv1\r\nmode: enforce\r\nmx: mx0.example.org\r\nmx: *.example.org\r\nmax_age: 604800\r\n",
+		},
+		{
+			policy: Policy{Mode: ModeEnforce, MaxAge: 8600},
+			fail:   true,
+		},
+		{
+			policy: Policy{Mode: "invalid", MaxAge: 8600},
+			fail:   true,
+		},
+		{
+			policy: Policy{Mode: ModeNone, MaxAge: -1},
+			fail:   true,
+		},
+		{
+			policy: Policy{Mode: ModeNone, MaxAge: 31557601},
+			fail:   true,
+		},
+		{
+			policy: Policy{Mode: ModeTesting, MaxAge: 8600, MX: []string{""}},
+			fail:   true,
+		},
+		{
+			policy: Policy{Mode: ModeTesting, MaxAge: 8600, MX: []string{"strange mx"}},
+			fail:   true,
+		},
+		{
+			policy: Policy{Mode: ModeTesting, MaxAge: 8600, MX: []string{"-mx.example.org"}},
+			fail:   true,
+		},
+		{
+			policy: Policy{Mode: ModeTesting, MaxAge: 8600, MX: []string{" mx0.example.org"}},
+			fail:   true,
+		},
+		{
+			policy: Policy{Mode: ModeTesting, MaxAge: 8600, MX: []string{"mx0.example.org\r\nmode: none"}},
+			fail:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%+v", c.policy), func(t *testing.T) {
+			var b strings.Builder
+			n, err := c.policy.WriteTo(&b)
+			if c.fail {
+				if err == nil {
+					t.Errorf("expected failure, but got %q", b.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected failure: %v", err)
+			}
+			if b.String() != c.text {
+				t.Errorf("wrong policy text, want %q, got %q", c.text, b.String())
+			}
+			if n != int64(b.Len()) {
+				t.Errorf("wrong length returned, want %v, got %v", b.Len(), n)
+			}
+
+			p, err := ParsePolicy(strings.NewReader(b.String()))
+			if err != nil {
+				t.Fatalf("round-trip failed: %v", err)
+			}
+			if !reflect.DeepEqual(*p, c.policy) {
+				t.Errorf("round-trip mismatch, want %+v, got %+v", c.policy, *p)
+			}
+		})
+	}
+}
+
+func TestParsePolicy_RoundTrip(t *testing.T) {
+	for _, text := range []string{
+		"version: STSv1\nmode: enforce\nmx: mx0.example.org\nmx: *.example.org\nmax_age: 604800\n",
+		"version: STSv1\r\nmode: none\r\nmax_age: 31557600\r\n",
+		"max_age: 86400\nmx:   mx0.example.org\t\nmode: testing\nversion: STSv1\nextension: value\n",
+	} {
+		t.Run(text, func(t *testing.T) {
+			p, err := ParsePolicy(strings.NewReader(text))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b strings.Builder
+			if _, err := p.WriteTo(&b); err != nil {
+				t.Fatalf("parsed policy not accepted by WriteTo: %v", err)
+			}
+			p2, err := ParsePolicy(strings.NewReader(b.String()))
+			if err != nil {
+				t.Fatalf("round-trip failed: %v", err)
+			}
+			if !reflect.DeepEqual(p, p2) {
+				t.Errorf("round-trip mismatch, want %+v, got %+v", p, p2)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package mtasts
+
+import (
+	"net"
+	"sort"
+)
+
+// RejectedMX is the MX record that is not permitted by the policy.
+type RejectedMX struct {
+	MX *net.MX
+
+	// Always VerifyError with VerifyMXNotAllowed reason.
+	Err error
+}
+
+// FilterMX splits MX records into ones permitted by the policy and ones
+// that are not.
+//
+// permitted is sorted by preference, the order of records with the same
+// preference is preserved. mxs slice is not modified.
+//
+// In ModeTesting all records are permitted, but rejected still contains ones
+// that do not match the policy so failures can be reported. In ModeNone all
+// records are permitted and rejected is always empty.
+func (p Policy) FilterMX(mxs []*net.MX) (permitted []*net.MX, rejected []RejectedMX) {
+	sorted := make([]*net.MX, len(mxs))
+	copy(sorted, mxs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Pref < sorted[j].Pref
+	})
+
+	if p.Mode == ModeNone {
+		return sorted, nil
+	}
+
+	permitted = make([]*net.MX, 0, len(sorted))
+	for _, mx := range sorted {
+		if p.Match(mx.Host) {
+			permitted = append(permitted, mx)
+			continue
+		}
+
+		rejected = append(rejected, RejectedMX{
+			MX:  mx,
+			Err: VerifyError{Reason: VerifyMXNotAllowed, MX: mx.Host},
+		})
+		if p.Mode == ModeTesting {
+			permitted = append(permitted, mx)
+		}
+	}
+	return permitted, rejected
+}
@@ -0,0 +1,64 @@
+package mtasts
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPolicyFilterMX(t *testing.T) {
+	mxs := []*net.MX{
+		{Host: "mx2.example.org.", Pref: 20},
+		{Host: "evil.example.com.", Pref: 5},
+		{Host: "mx1.example.org.", Pref: 10},
+		{Host: "backup.example.org.", Pref: 20},
+	}
+	mxsCpy := append([]*net.MX(nil), mxs...)
+
+	cases := []struct {
+		mode      Mode
+		permitted []*net.MX
+		rejected  []*net.MX
+	}{
+		{
+			mode:      ModeEnforce,
+			permitted: []*net.MX{mxs[2], mxs[0], mxs[3]},
+			rejected:  []*net.MX{mxs[1]},
+		},
+		{
+			mode:      ModeTesting,
+			permitted: []*net.MX{mxs[1], mxs[2], mxs[0], mxs[3]},
+			rejected:  []*net.MX{mxs[1]},
+		},
+		{
+			mode:      ModeNone,
+			permitted: []*net.MX{mxs[1], mxs[2], mxs[0], mxs[3]},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(string(c.mode), func(t *testing.T) {
+			p := Policy{Mode: c.mode, MX: []string{"*.example.org"}}
+
+			permitted, rejected := p.FilterMX(mxs)
+			if !reflect.DeepEqual(permitted, c.permitted) {
+				t.Errorf("wrong permitted list, want %v, got %v", c.permitted, permitted)
+			}
+			if len(rejected) != len(c.rejected) {
+				t.Fatalf("wrong rejected list, want %v, got %v", c.rejected, rejected)
+			}
+			for i, r := range rejected {
+				if r.MX != c.rejected[i] {
+					t.Errorf("wrong rejected MX, want %v, got %v", c.rejected[i], r.MX)
+				}
+				if verr, ok := r.Err.(VerifyError); !ok || verr.Reason != VerifyMXNotAllowed {
+					t.Errorf("wrong rejection reason: %v", r.Err)
+				}
+			}
+		})
+	}
+
+	if !reflect.DeepEqual(mxs, mxsCpy) {
+		t.Fatal("FilterMX modified the passed slice")
+	}
+}
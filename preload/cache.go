@@ -9,11 +9,26 @@ import (
 )
 
 type PreloadedCache struct {
+	// If non-nil, replaces time.Now as the source of the current time used
+	// for list expiry and policy timestamps.
+	//
+	// It is not inherited from mtasts.Cache.Now and should be set to the
+	// same function, otherwise preloaded policies will be considered
+	// expired or valid for longer than the list.
+	Now func() time.Time
+
 	lLock sync.RWMutex
 	l     *List
 	inner mtasts.Store
 }
 
+func (pc *PreloadedCache) now() time.Time {
+	if pc.Now != nil {
+		return pc.Now()
+	}
+	return time.Now()
+}
+
 func (pc *PreloadedCache) List() ([]string, error) {
 	return pc.inner.List()
 }
@@ -22,6 +37,40 @@ func (pc *PreloadedCache) Store(key string, id string, fetchTime time.Time, poli
 	return pc.inner.Store(key, id, fetchTime, policy)
 }
 
+// Delete removes the policy from the underlying store if it implements
+// mtasts.Deleter. Preload list entries are not affected.
+func (pc *PreloadedCache) Delete(key string) error {
+	deleter, ok := pc.inner.(mtasts.Deleter)
+	if !ok {
+		return nil
+	}
+	return deleter.Delete(key)
+}
+
+// DeleteIfFetched removes the policy from the underlying store if it was
+// stored with the specified fetch time. Preload list entries are not
+// affected.
+func (pc *PreloadedCache) DeleteIfFetched(key string, fetchTime time.Time) (bool, error) {
+	if deleter, ok := pc.inner.(mtasts.ConditionalDeleter); ok {
+		return deleter.DeleteIfFetched(key, fetchTime)
+	}
+	deleter, ok := pc.inner.(mtasts.Deleter)
+	if !ok {
+		return false, nil
+	}
+	_, storedTime, _, err := pc.inner.Load(key)
+	if err != nil {
+		if err == mtasts.ErrNoPolicy {
+			return false, nil
+		}
+		return false, err
+	}
+	if !storedTime.Equal(fetchTime) {
+		return false, nil
+	}
+	return true, deleter.Delete(key)
+}
+
 // Update replaces the List object used by PreloadedCache in the
 // goroutine-safe way.
 //
@@ -29,7 +78,7 @@ func (pc *PreloadedCache) Store(key string, id string, fetchTime time.Time, poli
 // the current list is newer than newList or when the newList is already
 // expired.
 func (pc *PreloadedCache) Update(newList *List) error {
-	if newList.Expired() {
+	if newList.ExpiredAt(pc.now()) {
 		return errors.New("mtasts/preload: the new list is expired")
 	}
 
@@ -56,7 +105,8 @@ func (pc *PreloadedCache) Load(key string) (string, time.Time, *mtasts.Policy, e
 	pc.lLock.RLock()
 	defer pc.lLock.RUnlock()
 
-	if pc.l.Expired() {
+	t := pc.now()
+	if pc.l.ExpiredAt(t) {
 		return "", time.Time{}, nil, mtasts.ErrNoPolicy
 	}
 
@@ -65,15 +115,18 @@ func (pc *PreloadedCache) Load(key string) (string, time.Time, *mtasts.Policy, e
 		return "", time.Time{}, nil, mtasts.ErrNoPolicy
 	}
 
-	sts := ent.STS(pc.l)
+	sts := ent.STSAt(pc.l, t)
 
 	// Use of non-sensical policy ID will ensure it will be always
 	// replaced when domain publishes an actual policy.
-	return "\x00PRELOADED", time.Now(), &sts, nil
+	return "\x00PRELOADED", t, &sts, nil
 }
 
 // WrapCache wraps the mtasts.Store to use the preload list as a second source
 // to fetch policies from.
+//
+// If the clock of mtasts.Cache is replaced using Cache.Now, PreloadedCache.Now
+// should be set too.
 func WrapCache(c mtasts.Store, l *List) *PreloadedCache {
 	return &PreloadedCache{l: l, inner: c}
 }
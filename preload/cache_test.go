@@ -25,13 +25,16 @@ func TestPreloadedCache(t *testing.T) {
 	}
 
 	c := mtasts.NewRAMCache()
+	c.Now = testNow
 	c.Resolver = &mockdns.Resolver{}
 	c.DownloadPolicy = mockDownloadPolicy(nil, errors.New("no"))
-	c.Store = WrapCache(c.Store, list)
+	store := WrapCache(c.Store, list)
+	store.Now = testNow
+	c.Store = store
 
 	expectedPolicy := &mtasts.Policy{
 		Mode:   mtasts.ModeTesting,
-		MaxAge: int(time.Time(list.Expires).Sub(now()).Seconds()),
+		MaxAge: int(time.Time(list.Expires).Sub(testNow()).Seconds()),
 		MX:     []string{"*.mail.google.com"},
 	}
 
@@ -53,11 +56,12 @@ func TestPreloadedCache_MTASTSPresent(t *testing.T) {
 
 	expectedPolicy := &mtasts.Policy{
 		Mode:   mtasts.ModeTesting,
-		MaxAge: int(time.Time(list.Expires).Sub(now()).Seconds()),
+		MaxAge: int(time.Time(list.Expires).Sub(testNow()).Seconds()),
 		MX:     []string{"*.override.google.com"},
 	}
 
 	c := mtasts.NewRAMCache()
+	c.Now = testNow
 	c.Resolver = &mockdns.Resolver{
 		Zones: map[string]mockdns.Zone{
 			"_mta-sts.gmail.com.": {
@@ -66,7 +70,9 @@ func TestPreloadedCache_MTASTSPresent(t *testing.T) {
 		},
 	}
 	c.DownloadPolicy = mockDownloadPolicy(expectedPolicy, nil)
-	c.Store = WrapCache(c.Store, list)
+	store := WrapCache(c.Store, list)
+	store.Now = testNow
+	c.Store = store
 
 	policy, err := c.Get(context.Background(), "gmail.com")
 	if err != nil {
@@ -85,10 +91,13 @@ func TestPreloadedCache_ListExpired(t *testing.T) {
 	}
 
 	c := mtasts.NewRAMCache()
+	c.Now = testNow
 	c.Resolver = &mockdns.Resolver{}
 
-	list.Expires = ListTime(now().Add(-10 * time.Second))
-	c.Store = WrapCache(c.Store, list)
+	list.Expires = ListTime(testNow().Add(-10 * time.Second))
+	store := WrapCache(c.Store, list)
+	store.Now = testNow
+	c.Store = store
 
 	_, err = c.Get(context.Background(), "gmail.com")
 	if err == nil {
@@ -104,9 +113,10 @@ func TestPreloadedCache_UpdateWithExpired(t *testing.T) {
 
 	c := mtasts.NewRAMCache()
 	store := WrapCache(c.Store, list)
+	store.Now = testNow
 
 	listCpy := *list
-	listCpy.Expires = ListTime(now().Add(-10 * time.Second))
+	listCpy.Expires = ListTime(testNow().Add(-10 * time.Second))
 
 	if err := store.Update(&listCpy); err == nil {
 		t.Fatal("Expected an error, got none")
@@ -121,6 +131,7 @@ func TestPreloadedCache_UpdateWithOlder(t *testing.T) {
 
 	c := mtasts.NewRAMCache()
 	store := WrapCache(c.Store, list)
+	store.Now = testNow
 
 	listCpy := *list
 	listCpy.Timestamp = ListTime(time.Time(list.Timestamp).Add(-10 * time.Second))
@@ -129,3 +140,29 @@ func TestPreloadedCache_UpdateWithOlder(t *testing.T) {
 		t.Fatal("Expected an error, got none")
 	}
 }
+
+func TestPreloadedCache_Clock(t *testing.T) {
+	list, err := Read(strings.NewReader(sampleList))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := WrapCache(mtasts.NewRAMCache().Store, list)
+	store.Now = func() time.Time { return time.Time(list.Expires).Add(-time.Hour) }
+
+	_, fetchTime, policy, err := store.Load("gmail.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fetchTime.Equal(store.Now()) {
+		t.Errorf("wrong fetch time: %v", fetchTime)
+	}
+	if policy.MaxAge != 3600 {
+		t.Errorf("wrong max_age: %v", policy.MaxAge)
+	}
+
+	store.Now = func() time.Time { return time.Time(list.Expires).Add(time.Second) }
+	if _, _, _, err := store.Load("gmail.com"); err != mtasts.ErrNoPolicy {
+		t.Errorf("expected ErrNoPolicy for the expired list, got %v", err)
+	}
+}
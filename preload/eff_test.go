@@ -5,19 +5,12 @@ package preload
 import (
 	"net/http"
 	"testing"
-	"time"
 )
 
 // This test checks whether go-mtasts/preload can properly consume the actual
 // EFF list as it is deployed.
 
 func TestEFFDownload(t *testing.T) {
-	oldNow := now
-	now = time.Now
-	defer func() {
-		now = oldNow
-	}()
-
 	list, err := Download(http.DefaultClient, STARTTLSEverywhere)
 	if err != nil {
 		t.Fatal(err)
@@ -13,8 +13,6 @@ import (
 	"golang.org/x/net/idna"
 )
 
-var now = time.Now
-
 type ListTime time.Time
 
 func (t *ListTime) MarshalJSON() ([]byte, error) {
@@ -111,16 +109,26 @@ func (l *List) Lookup(domain string) (e Entry, ok bool) {
 
 // Expired reports whether the list is expired and should be updated.
 func (l *List) Expired() bool {
-	return time.Time(l.Expires).Before(now())
+	return l.ExpiredAt(time.Now())
+}
+
+// ExpiredAt reports whether the list is expired at the time t.
+func (l *List) ExpiredAt(t time.Time) bool {
+	return time.Time(l.Expires).Before(t)
 }
 
 // STS converts the Entry into the equivalent MTA-STS policy.
 func (e *Entry) STS(l *List) mtasts.Policy {
+	return e.STSAt(l, time.Now())
+}
+
+// STSAt is similar to STS, but computes max_age relative to the time t.
+func (e *Entry) STSAt(l *List, t time.Time) mtasts.Policy {
 	policy := mtasts.Policy{
 		Mode: e.Mode,
 
 		// Set MaxAge so that policy will expire when the list expires.
-		MaxAge: int(time.Time(l.Expires).Sub(now()).Seconds()),
+		MaxAge: int(time.Time(l.Expires).Sub(t).Seconds()),
 
 		MX: make([]string, 0, len(e.MXs)),
 	}
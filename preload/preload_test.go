@@ -81,7 +81,7 @@ func TestRead(t *testing.T) {
 		t.Fatalf("Wrong structure output:\nWant %+v\nGot : %+v", sampleListParsed, l)
 	}
 
-	if l.Expired() {
+	if l.ExpiredAt(testNow()) {
 		t.Fatal("The list is reported as expired")
 	}
 }
@@ -149,10 +149,10 @@ func TestEntry_STS(t *testing.T) {
 			t.Fatal("Entry not found but should")
 		}
 
-		sts := ent.STS(l)
+		sts := ent.STSAt(l, testNow())
 		stsExpected := mtasts.Policy{
 			Mode:   mtasts.ModeTesting,
-			MaxAge: int(time.Time(l.Expires).Sub(now()).Seconds()),
+			MaxAge: int(time.Time(l.Expires).Sub(testNow()).Seconds()),
 			MX:     []string{"mail.example.com", "*.example.net"},
 		}
 		if !reflect.DeepEqual(sts, stsExpected) {
@@ -182,8 +182,7 @@ func TestRead_UnixTimestamp(t *testing.T) {
 	}
 }
 
-func init() {
-	now = func() time.Time {
-		return time.Date(2014, time.June, 6, 14, 30, 18, 0, time.UTC)
-	}
+// testNow returns the time when the sample list is not expired yet.
+func testNow() time.Time {
+	return time.Date(2014, time.June, 6, 14, 30, 18, 0, time.UTC)
 }
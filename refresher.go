@@ -0,0 +1,215 @@
+package mtasts
+
+import (
+	"context"
+	"runtime/trace"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRefreshInterval is used by Refresher if Interval is not set.
+	DefaultRefreshInterval = 12 * time.Hour
+
+	// minRefreshDelay prevents Refresher from spinning when some policies are
+	// due for refresh but cannot be fetched. Domains that keep failing are
+	// retried with exponentially increasing delay starting from
+	// minRefreshDelay, up to Interval.
+	minRefreshDelay = time.Minute
+)
+
+// RefreshResult contains the summary of a single Refresher run.
+//
+// Domains listed as skipped in the embedded RefreshReport were not checked
+// since their policies are not going to expire soon.
+type RefreshResult struct {
+	Started  time.Time
+	Finished time.Time
+
+	RefreshReport
+
+	// Err is set if the run failed as a whole, e.g. due to a Store.List
+	// error or context cancellation.
+	Err error
+}
+
+// Refresher periodically refreshes policies stored in the Cache so they
+// do not expire while domains still publish them.
+//
+// Each cached policy is scheduled for refresh based on its fetch time and
+// max_age value. Refresher wakes up when the earliest policy is about to
+// expire, but at least once per Interval.
+type Refresher struct {
+	Cache *Cache
+
+	// Maximum time between refresh runs. If zero, DefaultRefreshInterval is
+	// used.
+	Interval time.Duration
+
+	// Policies expiring within LookAhead are refreshed. If zero, half of
+	// Interval is used. For policies with max_age shorter than twice the
+	// LookAhead, half of max_age is used instead.
+	LookAhead time.Duration
+
+	lastLock sync.Mutex
+	last     RefreshResult
+
+	// Domains that failed to refresh, accessed only by runOnce.
+	backoff map[string]refreshBackoff
+}
+
+type refreshBackoff struct {
+	failures int
+	retry    time.Time
+}
+
+func (r *Refresher) interval() time.Duration {
+	if r.Interval == 0 {
+		return DefaultRefreshInterval
+	}
+	return r.Interval
+}
+
+func (r *Refresher) lookAhead() time.Duration {
+	if r.LookAhead == 0 {
+		return r.interval() / 2
+	}
+	return r.LookAhead
+}
+
+// LastResult returns the summary of the most recently finished run.
+//
+// Zero value is returned if there were no runs yet.
+func (r *Refresher) LastResult() RefreshResult {
+	r.lastLock.Lock()
+	defer r.lastLock.Unlock()
+	return r.last
+}
+
+// Run runs refresh loop until ctx is cancelled. The first run is done
+// immediately.
+//
+// Run always returns a non-nil error, ctx.Err() if it was stopped due to the
+// context cancellation.
+func (r *Refresher) Run(ctx context.Context) error {
+	for {
+		next := r.runOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		timer := time.NewTimer(next.Sub(r.Cache.now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// runOnce refreshes all policies that are due and returns the time of the
+// next run.
+func (r *Refresher) runOnce(ctx context.Context) time.Time {
+	ctx, task := trace.NewTask(ctx, "mtasts.Refresher/run")
+	defer task.End()
+
+	res := RefreshResult{Started: r.Cache.now()}
+	lookAhead := r.lookAhead()
+	next := res.Started.Add(r.interval())
+
+	// Entries for domains that are not due anymore or were removed from the
+	// cache are dropped.
+	backoff := make(map[string]refreshBackoff)
+	domainLookAhead := func(domain string) time.Duration {
+		_, _, policy, err := r.Cache.Store.Load(domain)
+		if err != nil {
+			return lookAhead
+		}
+		return policyLookAhead(lookAhead, policy)
+	}
+
+	report, err := r.Cache.refresh(ctx, domainLookAhead, func(domain string) bool {
+		now := r.Cache.now()
+		due, ok := r.dueTime(domain, lookAhead)
+		if !ok || !due.After(now) {
+			b, ok := r.backoff[domain]
+			if !ok || !b.retry.After(now) {
+				return false
+			}
+			backoff[domain] = b
+			due = b.retry
+		}
+		if due.Before(next) {
+			next = due
+		}
+		return true
+	})
+	res.Err = err
+	res.Finished = r.Cache.now()
+	if report != nil {
+		res.RefreshReport = *report
+
+		for _, list := range [][]string{report.Refreshed, report.Unchanged} {
+			for _, domain := range list {
+				if due, ok := r.dueTime(domain, lookAhead); ok && due.Before(next) {
+					next = due
+				}
+			}
+		}
+		for domain := range report.Failed {
+			b := r.backoff[domain]
+			b.failures++
+			b.retry = res.Finished.Add(r.retryDelay(b.failures))
+			backoff[domain] = b
+			if b.retry.Before(next) {
+				next = b.retry
+			}
+		}
+	}
+	r.backoff = backoff
+
+	if earliest := res.Finished.Add(minRefreshDelay); next.Before(earliest) {
+		next = earliest
+	}
+
+	r.lastLock.Lock()
+	r.last = res
+	r.lastLock.Unlock()
+
+	return next
+}
+
+// retryDelay returns the delay before the next refresh attempt for the domain
+// that failed to refresh the specified number of times in a row.
+func (r *Refresher) retryDelay(failures int) time.Duration {
+	delay := minRefreshDelay
+	for i := 1; i < failures && delay < r.interval(); i++ {
+		delay *= 2
+	}
+	if delay > r.interval() {
+		return r.interval()
+	}
+	return delay
+}
+
+// policyLookAhead returns the look-ahead to use for the policy. It is limited
+// to the half of max_age, otherwise policies with short max_age would be
+// refetched on every run.
+func policyLookAhead(lookAhead time.Duration, policy *Policy) time.Duration {
+	if half := time.Duration(policy.MaxAge) * time.Second / 2; half < lookAhead {
+		return half
+	}
+	return lookAhead
+}
+
+// dueTime returns the time when the cached policy for domain should be
+// refreshed.
+func (r *Refresher) dueTime(domain string, lookAhead time.Duration) (time.Time, bool) {
+	_, fetchTime, policy, err := r.Cache.Store.Load(domain)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expiry := fetchTime.Add(time.Duration(policy.MaxAge) * time.Second)
+	return expiry.Add(-policyLookAhead(lookAhead, policy)), true
+}
@@ -0,0 +1,232 @@
+package mtasts
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+)
+
+func waitRefreshRun(t *testing.T, r *Refresher) RefreshResult {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if res := r.LastResult(); !res.Finished.IsZero() {
+			return res
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("refresher did not run")
+	return RefreshResult{}
+}
+
+func TestRefresher(t *testing.T) {
+	expectedPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 60,
+		MX:     []string{"a"},
+	}
+	store := newRAMStore()
+	c := Cache{
+		Store: store,
+		Resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"_mta-sts.example.org.": {
+					TXT: []string{"v=STSv1; id=1234"},
+				},
+				"_mta-sts.example.com.": {
+					TXT: []string{"v=STSv1; id=1234"},
+				},
+			},
+		},
+		DownloadPolicy: mockDownloadPolicy(expectedPolicy, nil),
+	}
+
+	// Expires in 15 seconds, should be refreshed.
+	if err := store.Store("example.org", "1234", time.Now().Add(-45*time.Second), expectedPolicy); err != nil {
+		t.Fatal(err)
+	}
+	// Expires in a day, should be skipped.
+	if err := store.Store("example.com", "1234", time.Now(), &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPolicy = &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"b"},
+	}
+	c.DownloadPolicy = mockDownloadPolicy(expectedPolicy, nil)
+
+	r := &Refresher{Cache: &c, Interval: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	res := waitRefreshRun(t, r)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("unexpected Run error: %v", err)
+	}
+
+	if res.Err != nil || len(res.Refreshed) != 1 || len(res.Skipped) != 1 || len(res.Failed) != 0 {
+		t.Fatalf("unexpected run result: %+v", res)
+	}
+
+	_, _, policy, err := store.Load("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(policy, expectedPolicy) {
+		t.Fatalf("wrong policy stored, want %+v, got %+v", expectedPolicy, policy)
+	}
+}
+
+func TestRefresher_Error(t *testing.T) {
+	cachedPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 1,
+		MX:     []string{"a"},
+	}
+	store := newRAMStore()
+	c := Cache{
+		Store: store,
+		Resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"_mta-sts.example.org.": {
+					TXT: []string{"v=STSv1; id=1234"},
+				},
+			},
+		},
+		DownloadPolicy: mockDownloadPolicy(nil, errors.New("broken")),
+	}
+	if err := store.Store("example.org", "1234", time.Now().Add(-time.Minute), cachedPolicy); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Refresher{Cache: &c, Interval: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	res := waitRefreshRun(t, r)
+	cancel()
+	<-done
+
+	if len(res.Failed) != 1 {
+		t.Fatalf("unexpected run result: %+v", res)
+	}
+}
+
+func TestRefresher_ShortMaxAge(t *testing.T) {
+	policy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 3600,
+		MX:     []string{"a"},
+	}
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	downloads := 0
+	store := newRAMStore()
+	c := Cache{
+		Store: store,
+		Resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"_mta-sts.example.org.": {
+					TXT: []string{"v=STSv1; id=1234"},
+				},
+			},
+		},
+		DownloadPolicy: func(string) (*Policy, error) {
+			downloads++
+			return policy, nil
+		},
+		Now: func() time.Time { return now },
+	}
+	if err := store.Store("example.org", "1234", now, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	// Default LookAhead (6 hours) is longer than max_age, the policy should
+	// be refreshed only when half of max_age passes.
+	r := &Refresher{Cache: &c}
+	next := r.runOnce(context.Background())
+	if res := r.LastResult(); len(res.Skipped) != 1 || downloads != 0 {
+		t.Fatalf("fresh policy is not skipped: %+v", res)
+	}
+	if want := now.Add(30 * time.Minute); !next.Equal(want) {
+		t.Fatalf("wrong next run time, want %v, got %v", want, next)
+	}
+
+	now = next.Add(time.Second)
+	next = r.runOnce(context.Background())
+	if res := r.LastResult(); len(res.Refreshed) != 1 || downloads != 1 {
+		t.Fatalf("policy is not refreshed: %+v", res)
+	}
+	if want := now.Add(30 * time.Minute); !next.Equal(want) {
+		t.Fatalf("wrong next run time, want %v, got %v", want, next)
+	}
+}
+
+func TestRefresher_Backoff(t *testing.T) {
+	cachedPolicy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 3600,
+		MX:     []string{"a"},
+	}
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	store := newRAMStore()
+	c := Cache{
+		Store: store,
+		Resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"_mta-sts.example.org.": {
+					TXT: []string{"v=STSv1; id=5678"},
+				},
+			},
+		},
+		DownloadPolicy: mockDownloadPolicy(nil, errors.New("broken")),
+		Now:            func() time.Time { return now },
+	}
+	if err := store.Store("example.org", "1234", now.Add(-50*time.Minute), cachedPolicy); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Refresher{Cache: &c, Interval: time.Hour}
+	for _, delay := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		next := r.runOnce(context.Background())
+		if res := r.LastResult(); len(res.Failed) != 1 {
+			t.Fatalf("unexpected run result: %+v", res)
+		}
+		if want := now.Add(delay); !next.Equal(want) {
+			t.Fatalf("wrong retry time, want %v, got %v", want, next)
+		}
+
+		// Not retried before the delay passes.
+		now = now.Add(delay / 2)
+		r.runOnce(context.Background())
+		if res := r.LastResult(); len(res.Skipped) != 1 {
+			t.Fatalf("domain retried too early: %+v", res)
+		}
+		now = now.Add(delay / 2)
+	}
+
+	c.DownloadPolicy = mockDownloadPolicy(cachedPolicy, nil)
+	r.runOnce(context.Background())
+	if res := r.LastResult(); len(res.Refreshed) != 1 {
+		t.Fatalf("unexpected run result: %+v", res)
+	}
+	if len(r.backoff) != 0 {
+		t.Fatalf("backoff state is not reset: %v", r.backoff)
+	}
+}
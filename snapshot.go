@@ -0,0 +1,184 @@
+package mtasts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion is the version of the format written by Export.
+const SnapshotVersion = 1
+
+// snapshotFormat is the value of the "format" field in the snapshot header.
+const snapshotFormat = "mtasts-snapshot"
+
+type snapshotHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+type snapshotPolicy struct {
+	Mode   Mode     `json:"mode"`
+	MaxAge int      `json:"max_age"`
+	MX     []string `json:"mx,omitempty"`
+}
+
+type snapshotEntry struct {
+	Domain    string         `json:"domain"`
+	ID        string         `json:"id"`
+	FetchTime time.Time      `json:"fetch_time"`
+	Policy    snapshotPolicy `json:"policy"`
+}
+
+// Export writes all policies from the Store to w.
+//
+// The snapshot is a sequence of JSON objects, one per line. The first line is
+// the header:
+//
+//	{"format":"mtasts-snapshot","version":1}
+//
+// Each following line contains one cached policy (wrapped here for
+// readability):
+//
+//	{"domain":"example.org","id":"20190401","fetch_time":"2019-04-01T00:00:00Z",
+//	 "policy":{"mode":"enforce","max_age":86400,"mx":["mx.example.org"]}}
+//
+// fetch_time uses the RFC 3339 format. policy fields correspond to the fields
+// of the policy text defined by RFC 8461, "mx" is omitted if there are no
+// mx entries.
+//
+// Entries are sorted by domain. Keys removed from the Store while Export is
+// running are skipped.
+func Export(w io.Writer, s Store) error {
+	domains, err := s.List()
+	if err != nil {
+		return err
+	}
+	sort.Strings(domains)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(snapshotHeader{Format: snapshotFormat, Version: SnapshotVersion}); err != nil {
+		return err
+	}
+	for _, domain := range domains {
+		id, fetchTime, policy, err := s.Load(domain)
+		if err != nil {
+			if err == ErrNoPolicy {
+				continue
+			}
+			return err
+		}
+		err = enc.Encode(snapshotEntry{
+			Domain:    domain,
+			ID:        id,
+			FetchTime: fetchTime,
+			Policy: snapshotPolicy{
+				Mode:   policy.Mode,
+				MaxAge: policy.MaxAge,
+				MX:     policy.MX,
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportError is returned by Import if some entries were not imported.
+type ImportError struct {
+	// Reasons for skipping entries, keyed by the entry number. Entries are
+	// numbered from 1, not counting the header.
+	Skipped map[int]error
+}
+
+func (e ImportError) Error() string {
+	return fmt.Sprintf("mtasts: %d snapshot entries not imported", len(e.Skipped))
+}
+
+// Import reads the snapshot written by Export and saves contained policies
+// to the Store.
+//
+// Entries are not imported if the Store already contains a policy for the
+// same domain fetched at the same time or later, so importing an old
+// snapshot does not replace more recent data.
+//
+// Invalid entries and entries the Store fails to save are skipped and
+// reported using ImportError after the rest of the snapshot is imported.
+// Import stops only if the snapshot cannot be decoded further.
+func Import(s Store, r io.Reader) error {
+	dec := json.NewDecoder(r)
+
+	var hdr snapshotHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return fmt.Errorf("mtasts: malformed snapshot header: %w", err)
+	}
+	if hdr.Format != snapshotFormat {
+		return fmt.Errorf("mtasts: not a policy snapshot")
+	}
+	if hdr.Version != SnapshotVersion {
+		return fmt.Errorf("mtasts: unsupported snapshot version: %d", hdr.Version)
+	}
+
+	skipped := make(map[int]error)
+	for i := 1; ; i++ {
+		var entry snapshotEntry
+		if err := dec.Decode(&entry); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("mtasts: malformed snapshot entry %d: %w", i, err)
+		}
+
+		if err := importEntry(s, entry); err != nil {
+			skipped[i] = err
+		}
+	}
+
+	if len(skipped) != 0 {
+		return ImportError{Skipped: skipped}
+	}
+	return nil
+}
+
+func importEntry(s Store, entry snapshotEntry) error {
+	if entry.Domain == "" {
+		return fmt.Errorf("mtasts: missing domain")
+	}
+	// IDs are not checked using validID since caches created by previous
+	// versions can contain IDs that are not valid anymore.
+	if entry.ID == "" {
+		return fmt.Errorf("mtasts: missing id for %s", entry.Domain)
+	}
+	// Policies are checked the same way as fetched ones, not using
+	// Policy.Validate, since the cache can contain policies that are accepted
+	// by the parser but violate RFC 8461.
+	var text bytes.Buffer
+	_, err := writePolicy(&text, Policy{
+		Mode:   entry.Policy.Mode,
+		MaxAge: entry.Policy.MaxAge,
+		MX:     entry.Policy.MX,
+	})
+	if err != nil {
+		return err
+	}
+	policy, err := readPolicy(&text)
+	if err != nil {
+		return fmt.Errorf("mtasts: invalid policy for %s: %w", entry.Domain, err)
+	}
+
+	_, fetchTime, _, err := s.Load(entry.Domain)
+	switch {
+	case err == nil:
+		if !fetchTime.Before(entry.FetchTime) {
+			return nil
+		}
+	case err != ErrNoPolicy:
+		return err
+	}
+
+	return s.Store(entry.Domain, entry.ID, entry.FetchTime, policy)
+}
@@ -0,0 +1,110 @@
+package mtasts
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	src := fsStore{Dir: tempDir(t)}
+
+	enforce := &Policy{Mode: ModeEnforce, MaxAge: 86400, MX: []string{"mx.example.org", "*.example.org"}}
+	none := &Policy{Mode: ModeNone, MaxAge: 86400}
+	fetchTime := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	if err := src.Store("example.org", "1234", fetchTime, enforce); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Store("example.net", "5678", fetchTime, none); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Export(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"format":"mtasts-snapshot","version":1}
+{"domain":"example.net","id":"5678","fetch_time":"2019-04-01T00:00:00Z","policy":{"mode":"none","max_age":86400}}
+{"domain":"example.org","id":"1234","fetch_time":"2019-04-01T00:00:00Z","policy":{"mode":"enforce","max_age":86400,"mx":["mx.example.org","*.example.org"]}}
+`
+	if buf.String() != expected {
+		t.Fatalf("wrong snapshot:\n%s", buf.String())
+	}
+
+	dst := newRAMStore()
+	// More recent entry should not be replaced.
+	newer := &Policy{Mode: ModeTesting, MaxAge: 86400, MX: []string{"mx.example.net"}}
+	if err := dst.Store("example.net", "9999", fetchTime.Add(time.Hour), newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := Import(dst, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	id, loadedTime, loadedPolicy, err := dst.Load("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1234" || !loadedTime.Equal(fetchTime) || !reflect.DeepEqual(loadedPolicy, enforce) {
+		t.Errorf("wrong data imported: %v %v %+v", id, loadedTime, loadedPolicy)
+	}
+	if id, _, _, err := dst.Load("example.net"); err != nil || id != "9999" {
+		t.Errorf("newer entry replaced: %v %v", id, err)
+	}
+}
+
+func TestImport_Malformed(t *testing.T) {
+	test := func(name, snapshot string) {
+		t.Helper()
+		t.Run(name, func(t *testing.T) {
+			if err := Import(newRAMStore(), strings.NewReader(snapshot)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+
+	test("empty", "")
+	test("wrong format", `{"format":"something","version":1}`)
+	test("future version", `{"format":"mtasts-snapshot","version":2}`)
+	test("truncated", snapshotHdr+`{"domain":"example.org","id":"1234",`)
+}
+
+const snapshotHdr = `{"format":"mtasts-snapshot","version":1}` + "\n"
+
+func TestImport_Skipped(t *testing.T) {
+	snapshot := snapshotHdr +
+		`{"id":"1234","fetch_time":"2019-04-01T00:00:00Z","policy":{"mode":"none","max_age":86400}}` + "\n" +
+		// ID format used by previous versions.
+		`{"domain":"example.org","id":"2019-04-01","fetch_time":"2019-04-01T00:00:00Z","policy":{"mode":"none","max_age":86400}}` + "\n" +
+		`{"domain":"example.net","id":"","fetch_time":"2019-04-01T00:00:00Z","policy":{"mode":"none","max_age":86400}}` + "\n" +
+		`{"domain":"example.com","id":"1234","fetch_time":"2019-04-01T00:00:00Z","policy":{"mode":"enforce","max_age":86400}}` + "\n" +
+		`{"domain":"example.info","id":"1234","fetch_time":"2019-04-01T00:00:00Z","policy":{"mode":"testing","max_age":86400,"mx":["mx.example.info"]}}` + "\n"
+
+	s := newRAMStore()
+	err := Import(s, strings.NewReader(snapshot))
+	ierr, ok := err.(ImportError)
+	if !ok {
+		t.Fatalf("expected ImportError, got %T: %v", err, err)
+	}
+	skipped := make([]int, 0, len(ierr.Skipped))
+	for i := range ierr.Skipped {
+		skipped = append(skipped, i)
+	}
+	sort.Ints(skipped)
+	if !reflect.DeepEqual(skipped, []int{1, 3, 4}) {
+		t.Errorf("wrong skipped entries: %v", ierr.Skipped)
+	}
+
+	// Entries after the invalid ones are imported.
+	for _, domain := range []string{"example.org", "example.info"} {
+		if _, _, _, err := s.Load(domain); err != nil {
+			t.Errorf("%s not imported: %v", domain, err)
+		}
+	}
+	if id, _, _, _ := s.Load("example.org"); id != "2019-04-01" {
+		t.Errorf("wrong id imported: %v", id)
+	}
+}
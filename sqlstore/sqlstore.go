@@ -0,0 +1,243 @@
+// Package sqlstore implements mtasts.Store on top of database/sql.
+//
+// It allows multiple MTA instances to share a single policy cache so a
+// policy learned by one instance protects deliveries made by others.
+//
+// SQLite and PostgreSQL dialects are supported. The caller is responsible
+// for importing the appropriate driver.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+)
+
+const (
+	DialectSQLite   = "sqlite3"
+	DialectPostgres = "postgres"
+)
+
+// migrations contains schema changes. Each entry upgrades the schema from
+// version i to i+1.
+var migrations = []string{
+	`CREATE TABLE mtasts_policies (
+		domain TEXT NOT NULL PRIMARY KEY,
+		id TEXT NOT NULL,
+		fetch_time BIGINT NOT NULL,
+		policy TEXT NOT NULL
+	)`,
+}
+
+// Store is the mtasts.Store implementation backed by the SQL database.
+//
+// It is goroutine-safe as long as the database driver is.
+type Store struct {
+	db      *sql.DB
+	dialect string
+}
+
+// New initializes the Store using the database connection db and applies
+// the schema migrations if necessary.
+//
+// dialect should be either DialectSQLite or DialectPostgres.
+func New(db *sql.DB, dialect string) (*Store, error) {
+	switch dialect {
+	case DialectSQLite, DialectPostgres:
+	default:
+		return nil, fmt.Errorf("mtasts/sqlstore: unsupported dialect: %s", dialect)
+	}
+
+	s := &Store{db: db, dialect: dialect}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// rebind converts ? placeholders into the form used by the dialect.
+func (s *Store) rebind(query string) string {
+	if s.dialect != DialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// SchemaVersion returns the current version of the database schema.
+func (s *Store) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.QueryRow(`SELECT version FROM mtasts_schema WHERE id = 1`).Scan(&version)
+	return version, err
+}
+
+// migrationLockID is the PostgreSQL advisory lock key used to serialize
+// concurrent migrations.
+const migrationLockID = 0x6d7461737473
+
+func (s *Store) migrate() error {
+	ctx := context.Background()
+
+	// The transaction is started manually on the dedicated connection since
+	// database/sql does not allow to request BEGIN IMMEDIATE for SQLite.
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Lock the database before reading the schema version so MTA instances
+	// starting concurrently do not apply the same migrations twice.
+	begin := `BEGIN`
+	if s.dialect == DialectSQLite {
+		begin = `BEGIN IMMEDIATE`
+	}
+	if _, err := conn.ExecContext(ctx, begin); err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			conn.ExecContext(ctx, `ROLLBACK`)
+		}
+	}()
+	if s.dialect == DialectPostgres {
+		// CREATE TABLE IF NOT EXISTS is not safe against concurrent use.
+		if _, err := conn.ExecContext(ctx, s.rebind(`SELECT pg_advisory_xact_lock(?)`), migrationLockID); err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS mtasts_schema (
+		id INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+		version INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `INSERT INTO mtasts_schema (id, version) VALUES (1, 0) ON CONFLICT (id) DO NOTHING`)
+	if err != nil {
+		return err
+	}
+
+	query := `SELECT version FROM mtasts_schema WHERE id = 1`
+	if s.dialect == DialectPostgres {
+		query += ` FOR UPDATE`
+	}
+	var version int
+	if err := conn.QueryRowContext(ctx, query).Scan(&version); err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("mtasts/sqlstore: unsupported schema version: %d", version)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if _, err := conn.ExecContext(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("mtasts/sqlstore: migration to version %d failed: %w", i+1, err)
+		}
+	}
+	if _, err := conn.ExecContext(ctx, s.rebind(`UPDATE mtasts_schema SET version = ? WHERE id = 1`), len(migrations)); err != nil {
+		return err
+	}
+
+	if _, err := conn.ExecContext(ctx, `COMMIT`); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+func (s *Store) List() ([]string, error) {
+	rows, err := s.db.Query(`SELECT domain FROM mtasts_policies`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+// Store inserts or updates the cached policy.
+//
+// If the database already contains a policy fetched at the same time or
+// later (e.g. by another MTA instance), it is left intact and no error is
+// returned.
+func (s *Store) Store(key, id string, fetchTime time.Time, p *mtasts.Policy) error {
+	blob, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(s.rebind(`INSERT INTO mtasts_policies (domain, id, fetch_time, policy)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (domain) DO UPDATE
+		SET id = excluded.id, fetch_time = excluded.fetch_time, policy = excluded.policy
+		WHERE mtasts_policies.fetch_time < excluded.fetch_time`),
+		key, id, fetchTime.UnixNano(), string(blob))
+	return err
+}
+
+func (s *Store) Load(key string) (id string, fetchTime time.Time, p *mtasts.Policy, err error) {
+	var (
+		fetchTimeNs int64
+		blob        string
+	)
+	err = s.db.QueryRow(s.rebind(`SELECT id, fetch_time, policy FROM mtasts_policies WHERE domain = ?`), key).
+		Scan(&id, &fetchTimeNs, &blob)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", time.Time{}, nil, mtasts.ErrNoPolicy
+		}
+		return "", time.Time{}, nil, err
+	}
+
+	p = &mtasts.Policy{}
+	if err := json.Unmarshal([]byte(blob), p); err != nil {
+		return "", time.Time{}, nil, err
+	}
+	return id, time.Unix(0, fetchTimeNs), p, nil
+}
+
+func (s *Store) Delete(key string) error {
+	_, err := s.db.Exec(s.rebind(`DELETE FROM mtasts_policies WHERE domain = ?`), key)
+	return err
+}
+
+func (s *Store) DeleteIfFetched(key string, fetchTime time.Time) (bool, error) {
+	res, err := s.db.Exec(s.rebind(`DELETE FROM mtasts_policies WHERE domain = ? AND fetch_time = ?`),
+		key, fetchTime.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
@@ -0,0 +1,189 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testDBPath(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mtasts-sqlstore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "cache.db")
+}
+
+func openTestDBPath(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=10000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	return openTestDBPath(t, testDBPath(t))
+}
+
+func TestStore(t *testing.T) {
+	db := openTestDB(t)
+	s, err := New(db, DialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := s.Load("example.org"); err != mtasts.ErrNoPolicy {
+		t.Fatalf("expected ErrNoPolicy, got %v", err)
+	}
+
+	policy := &mtasts.Policy{
+		Mode:   mtasts.ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.org"},
+	}
+	fetchTime := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	for _, domain := range []string{"example.org", "example.com", "example.net"} {
+		if err := s.Store(domain, "1234", fetchTime, policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("example.net"); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(list)
+	if !reflect.DeepEqual(list, []string{"example.com", "example.org"}) {
+		t.Fatalf("wrong list: %v", list)
+	}
+
+	// Newer fetch replaces the stored policy.
+	newPolicy := &mtasts.Policy{
+		Mode:   mtasts.ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx2.example.org"},
+	}
+	newFetchTime := fetchTime.Add(time.Hour)
+	if err := s.Store("example.org", "2345", newFetchTime, newPolicy); err != nil {
+		t.Fatal(err)
+	}
+	// ... but an older one does not.
+	if err := s.Store("example.org", "1234", fetchTime, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	id, loadedTime, loadedPolicy, err := s.Load("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "2345" || !loadedTime.Equal(newFetchTime) || !reflect.DeepEqual(loadedPolicy, newPolicy) {
+		t.Fatalf("wrong data loaded: %v %v %+v", id, loadedTime, loadedPolicy)
+	}
+
+	// Policy replaced since the checked fetch is not deleted.
+	if deleted, err := s.DeleteIfFetched("example.org", fetchTime); err != nil || deleted {
+		t.Fatalf("DeleteIfFetched with old fetch time: %v %v", deleted, err)
+	}
+	if deleted, err := s.DeleteIfFetched("example.org", newFetchTime); err != nil || !deleted {
+		t.Fatalf("DeleteIfFetched with current fetch time: %v %v", deleted, err)
+	}
+	if _, _, _, err := s.Load("example.org"); err != mtasts.ErrNoPolicy {
+		t.Fatalf("expected ErrNoPolicy after DeleteIfFetched, got %v", err)
+	}
+}
+
+func TestNew_Migrations(t *testing.T) {
+	db := openTestDB(t)
+	s, err := New(db, DialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store("example.org", "1234", time.Now(), &mtasts.Policy{Mode: mtasts.ModeNone}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Repeated initialization should keep the data.
+	s, err = New(db, DialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := s.SchemaVersion(); err != nil || version != len(migrations) {
+		t.Fatalf("wrong schema version: %v %v", version, err)
+	}
+	if _, _, _, err := s.Load("example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`UPDATE mtasts_schema SET version = 999`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(db, DialectSQLite); err == nil {
+		t.Fatal("expected an error for unsupported schema version")
+	}
+}
+
+func TestNew_Concurrent(t *testing.T) {
+	path := testDBPath(t)
+
+	// Separate handles, as if used by different MTA instances.
+	const instances = 8
+	dbs := make([]*sql.DB, instances)
+	for i := range dbs {
+		dbs[i] = openTestDBPath(t, path)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, instances)
+	for _, db := range dbs {
+		wg.Add(1)
+		go func(db *sql.DB) {
+			defer wg.Done()
+			_, err := New(db, DialectSQLite)
+			errs <- err
+		}(db)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rows int
+	if err := dbs[0].QueryRow(`SELECT COUNT(*) FROM mtasts_schema`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Fatalf("expected a single schema version row, got %d", rows)
+	}
+	if _, err := dbs[0].Exec(`INSERT INTO mtasts_schema (id, version) VALUES (2, 0)`); err == nil {
+		t.Fatal("second schema version row accepted")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	s := Store{dialect: DialectPostgres}
+	const query = `SELECT a FROM b WHERE c = ? AND d = ?`
+	if q := s.rebind(query); q != `SELECT a FROM b WHERE c = $1 AND d = $2` {
+		t.Fatalf("wrong rebind result: %v", q)
+	}
+}
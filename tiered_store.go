@@ -0,0 +1,135 @@
+package mtasts
+
+import (
+	"net"
+	"time"
+)
+
+// TieredStore is the Store implementation that keeps a copy of the policies
+// from the persistent Store in RAM.
+//
+// Load is served from RAM if possible and falls back to the persistent Store,
+// Store and Delete update both. List is always served from the persistent
+// Store.
+//
+// Changes made to the persistent Store bypassing TieredStore (e.g. by another
+// process sharing the same directory) are not visible for the keys already
+// present in RAM.
+type TieredStore struct {
+	// RAM is the Store used as a front layer. It is supposed to be fast and
+	// goroutine-safe, such as LRUStore.
+	RAM Store
+
+	// Backing is the persistent Store.
+	Backing Store
+}
+
+// NewTieredStore creates the TieredStore using backing as the persistent
+// Store.
+//
+// If ram is nil, the unbounded RAM map is used. The RAM layer is filled with
+// policies listed by the backing Store. Entries that fail to load are skipped,
+// they will be retried on access.
+func NewTieredStore(ram, backing Store) (*TieredStore, error) {
+	if ram == nil {
+		ram = newRAMStore()
+	}
+	s := &TieredStore{RAM: ram, Backing: backing}
+	if err := s.warm(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *TieredStore) warm() error {
+	keys, err := s.Backing.List()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		id, fetchTime, policy, err := s.Backing.Load(key)
+		if err != nil {
+			continue
+		}
+		if err := s.RAM.Store(key, id, fetchTime, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *TieredStore) List() ([]string, error) {
+	return s.Backing.List()
+}
+
+func (s *TieredStore) Store(key string, id string, fetchTime time.Time, policy *Policy) error {
+	err := s.Backing.Store(key, id, fetchTime, policy)
+	// Keep the RAM copy up to date even if the persistent Store failed, the
+	// policy is used by Cache anyway.
+	if ramErr := s.RAM.Store(key, id, fetchTime, policy); err == nil {
+		err = ramErr
+	}
+	return err
+}
+
+func (s *TieredStore) Load(key string) (id string, fetchTime time.Time, policy *Policy, err error) {
+	id, fetchTime, policy, err = s.RAM.Load(key)
+	if err != ErrNoPolicy {
+		return id, fetchTime, policy, err
+	}
+
+	id, fetchTime, policy, err = s.Backing.Load(key)
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+	if err := s.RAM.Store(key, id, fetchTime, policy); err != nil {
+		return "", time.Time{}, nil, err
+	}
+	return id, fetchTime, policy, nil
+}
+
+// Delete removes the key from both layers. Each layer that does not implement
+// Deleter is skipped.
+func (s *TieredStore) Delete(key string) error {
+	if d, ok := s.Backing.(Deleter); ok {
+		if err := d.Delete(key); err != nil {
+			return err
+		}
+	}
+	if d, ok := s.RAM.(Deleter); ok {
+		if err := d.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteIfFetched removes the key from both layers if it was stored with the
+// specified fetch time. Layers are checked separately, so the stale RAM copy
+// is removed even if the backing store contains a newer policy.
+func (s *TieredStore) DeleteIfFetched(key string, fetchTime time.Time) (bool, error) {
+	backingDeleted, err := deleteIfFetched(s.Backing, key, fetchTime)
+	if err != nil {
+		return false, err
+	}
+	ramDeleted, err := deleteIfFetched(s.RAM, key, fetchTime)
+	if err != nil {
+		return false, err
+	}
+	return backingDeleted || ramDeleted, nil
+}
+
+// NewTieredCache creates the Cache object using TieredStore on top of the
+// backing Store.
+//
+// See NewTieredStore for details.
+func NewTieredCache(ram, backing Store) (*Cache, error) {
+	store, err := NewTieredStore(ram, backing)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{
+		Store:    store,
+		Resolver: net.DefaultResolver,
+	}, nil
+}
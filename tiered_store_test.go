@@ -0,0 +1,76 @@
+package mtasts
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTieredStore(t *testing.T) {
+	dir := tempDir(t)
+	backing := fsStore{Dir: dir}
+
+	policy := &Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.org"},
+	}
+	fetchTime := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	if err := backing.Store("example.org", "1234", fetchTime, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	ram := newRAMStore()
+	s, err := NewTieredStore(ram, backing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Warmed from the backing store.
+	if _, _, _, err := ram.Load("example.org"); err != nil {
+		t.Fatalf("RAM layer is not warmed: %v", err)
+	}
+
+	// Served from RAM, backing store is not accessed.
+	if err := os.Remove(filepath.Join(dir, "example.org")); err != nil {
+		t.Fatal(err)
+	}
+	id, loadedTime, loadedPolicy, err := s.Load("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1234" || !loadedTime.Equal(fetchTime) || !reflect.DeepEqual(loadedPolicy, policy) {
+		t.Errorf("wrong data loaded: %v %v %+v", id, loadedTime, loadedPolicy)
+	}
+
+	// Read-through for entries added bypassing TieredStore.
+	if err := backing.Store("example.net", "5678", fetchTime, policy); err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _, err := s.Load("example.net"); err != nil || id != "5678" {
+		t.Fatalf("read-through failed: %v %v", id, err)
+	}
+	if _, _, _, err := ram.Load("example.net"); err != nil {
+		t.Errorf("RAM layer is not updated on read-through: %v", err)
+	}
+
+	// Write-through.
+	if err := s.Store("example.com", "9999", fetchTime, policy); err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _, err := backing.Load("example.com"); err != nil || id != "9999" {
+		t.Errorf("backing store is not updated: %v %v", id, err)
+	}
+	if id, _, _, err := ram.Load("example.com"); err != nil || id != "9999" {
+		t.Errorf("RAM layer is not updated: %v %v", id, err)
+	}
+
+	if err := s.Delete("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.Load("example.com"); err != ErrNoPolicy {
+		t.Errorf("expected ErrNoPolicy after Delete, got %v", err)
+	}
+}
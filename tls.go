@@ -0,0 +1,187 @@
+package mtasts
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// VerifyErrorReason describes why the server certificate was not accepted
+// for the MX.
+type VerifyErrorReason int
+
+const (
+	// The MX host is not permitted by the policy.
+	VerifyMXNotAllowed VerifyErrorReason = iota + 1
+	// The server did not present a certificate.
+	VerifyNoCertificate
+	// The certificate chain is not signed by a trusted CA.
+	VerifyUntrusted
+	// The certificate or one of its issuers is expired or not valid yet.
+	VerifyExpired
+	// The certificate is not valid for the MX host name.
+	VerifyHostMismatch
+	// TLS was not negotiated since the handshake failed.
+	VerifyTLSFailed
+	// TLS was not negotiated since the server does not offer STARTTLS.
+	VerifyNoSTARTTLS
+)
+
+func (r VerifyErrorReason) String() string {
+	switch r {
+	case VerifyMXNotAllowed:
+		return "MX not allowed by policy"
+	case VerifyNoCertificate:
+		return "no certificate"
+	case VerifyUntrusted:
+		return "untrusted certificate"
+	case VerifyExpired:
+		return "expired certificate"
+	case VerifyHostMismatch:
+		return "certificate host mismatch"
+	case VerifyTLSFailed:
+		return "TLS negotiation failed"
+	case VerifyNoSTARTTLS:
+		return "STARTTLS not supported"
+	}
+	return fmt.Sprintf("VerifyErrorReason(%d)", int(r))
+}
+
+// VerifyError is returned by functions created using Policy.VerifyConnection
+// and Policy.TLSConfig when the connection does not satisfy the policy.
+type VerifyError struct {
+	Reason VerifyErrorReason
+	MX     string
+	Err    error
+}
+
+func (e VerifyError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("mtasts: %s: %v", e.MX, e.Reason)
+	}
+	return fmt.Sprintf("mtasts: %s: %v: %v", e.MX, e.Reason, e.Err)
+}
+
+func (e VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyConnection returns a function suitable for use as
+// tls.Config.VerifyConnection that checks the connection to the mx host
+// according to RFC 8461, Section 4.
+//
+// The mx host must be permitted by the policy and the server certificate
+// must be issued by the CA from roots (system roots if nil) and be valid for
+// mx. Subject CN is not used for the host name check.
+//
+// The check is performed regardless of the policy mode. It is up to the
+// caller to ignore failures in testing mode.
+func (p Policy) VerifyConnection(mx string, roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		return p.verifyCerts(mx, roots, cs.PeerCertificates)
+	}
+}
+
+// TLSConfig returns a copy of base (or empty config if it is nil)
+// configured to verify the connection to the mx host as done by
+// VerifyConnection.
+//
+// base.RootCAs is used as a set of trusted CAs. ServerName is set to mx.
+//
+// The returned config has InsecureSkipVerify set since verification is done
+// in VerifyConnection instead of the default one. Unlike
+// VerifyPeerCertificate, it is also called for resumed sessions, so
+// base.ClientSessionCache can be shared with connections that do not
+// verify certificates. base.VerifyConnection, if set, is called after the
+// policy check. base.VerifyPeerCertificate, if set, is called by crypto/tls
+// before the policy check, only for full handshakes, and with nil
+// verifiedChains since the default verification is disabled.
+func (p Policy) TLSConfig(mx string, base *tls.Config) *tls.Config {
+	var cfg *tls.Config
+	if base == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = base.Clone()
+	}
+
+	cfg.ServerName = strings.TrimSuffix(mx, ".")
+	cfg.InsecureSkipVerify = true
+
+	verify := p.VerifyConnection(mx, cfg.RootCAs)
+	next := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := verify(cs); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(cs)
+		}
+		return nil
+	}
+	return cfg
+}
+
+func (p Policy) verifyCerts(mx string, roots *x509.CertPool, certs []*x509.Certificate) error {
+	if !p.Match(mx) {
+		return VerifyError{Reason: VerifyMXNotAllowed, MX: mx}
+	}
+	if len(certs) == 0 {
+		return VerifyError{Reason: VerifyNoCertificate, MX: mx}
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   time.Now(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		if invalidErr, ok := err.(x509.CertificateInvalidError); ok && invalidErr.Reason == x509.Expired {
+			return VerifyError{Reason: VerifyExpired, MX: mx, Err: err}
+		}
+		return VerifyError{Reason: VerifyUntrusted, MX: mx, Err: err}
+	}
+
+	if !matchCertHost(certs[0], mx) {
+		return VerifyError{Reason: VerifyHostMismatch, MX: mx}
+	}
+	return nil
+}
+
+// matchCertHost checks whether any of DNS SANs of the certificate matches
+// the host as defined by RFC 8461, Section 4.2.
+//
+// Wildcard SAN matches only the left-most label of host.
+func matchCertHost(cert *x509.Certificate, host string) bool {
+	normHost, err := forLookup(host)
+	if err != nil {
+		return false
+	}
+
+	for _, san := range cert.DNSNames {
+		normSAN, err := forLookup(san)
+		if err != nil {
+			continue
+		}
+
+		if strings.HasPrefix(normSAN, "*.") {
+			firstDot := strings.Index(normHost, ".")
+			if firstDot == -1 {
+				continue
+			}
+			if normHost[firstDot:] == normSAN[1:] {
+				return true
+			}
+			continue
+		}
+
+		if normHost == normSAN {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+package mtasts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, cn string, sans []string, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	cert, _ := ca.issueKeyPair(t, cn, sans, notAfter)
+	return cert
+}
+
+func (ca *testCA) issueKeyPair(t *testing.T, cn string, sans []string, notAfter time.Time) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     sans,
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestPolicyVerifyConnection(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	validUntil := time.Now().Add(time.Hour)
+
+	policy := Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.org", "*.example.net"},
+	}
+
+	cases := []struct {
+		name   string
+		mx     string
+		certs  []*x509.Certificate
+		reason VerifyErrorReason
+	}{
+		{
+			name:  "valid",
+			mx:    "mx.example.org",
+			certs: []*x509.Certificate{ca.issue(t, "", []string{"mx.example.org"}, validUntil)},
+		},
+		{
+			name:  "wildcard",
+			mx:    "mx1.example.net.",
+			certs: []*x509.Certificate{ca.issue(t, "", []string{"*.example.net"}, validUntil)},
+		},
+		{
+			name:   "wildcard too deep",
+			mx:     "a.mx1.example.net",
+			certs:  []*x509.Certificate{ca.issue(t, "", []string{"*.example.net"}, validUntil)},
+			reason: VerifyMXNotAllowed,
+		},
+		{
+			name:   "wildcard SAN too shallow",
+			mx:     "mx.example.org",
+			certs:  []*x509.Certificate{ca.issue(t, "", []string{"*.org"}, validUntil)},
+			reason: VerifyHostMismatch,
+		},
+		{
+			name:   "mx not allowed",
+			mx:     "mx.example.com",
+			certs:  []*x509.Certificate{ca.issue(t, "", []string{"mx.example.com"}, validUntil)},
+			reason: VerifyMXNotAllowed,
+		},
+		{
+			name:   "no certificate",
+			mx:     "mx.example.org",
+			reason: VerifyNoCertificate,
+		},
+		{
+			name:   "untrusted",
+			mx:     "mx.example.org",
+			certs:  []*x509.Certificate{otherCA.issue(t, "", []string{"mx.example.org"}, validUntil)},
+			reason: VerifyUntrusted,
+		},
+		{
+			name:   "expired",
+			mx:     "mx.example.org",
+			certs:  []*x509.Certificate{ca.issue(t, "", []string{"mx.example.org"}, time.Now().Add(-time.Hour))},
+			reason: VerifyExpired,
+		},
+		{
+			name:   "host mismatch",
+			mx:     "mx.example.org",
+			certs:  []*x509.Certificate{ca.issue(t, "", []string{"mx2.example.org"}, validUntil)},
+			reason: VerifyHostMismatch,
+		},
+		{
+			name:   "common name only",
+			mx:     "mx.example.org",
+			certs:  []*x509.Certificate{ca.issue(t, "mx.example.org", nil, validUntil)},
+			reason: VerifyHostMismatch,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			check := func(err error) {
+				t.Helper()
+				if c.reason == 0 {
+					if err != nil {
+						t.Fatalf("unexpected failure: %v", err)
+					}
+					return
+				}
+				verr, ok := err.(VerifyError)
+				if !ok {
+					t.Fatalf("expected VerifyError, got %T: %v", err, err)
+				}
+				if verr.Reason != c.reason {
+					t.Fatalf("wrong failure reason, want %v, got %v", c.reason, verr.Reason)
+				}
+			}
+
+			check(policy.VerifyConnection(c.mx, ca.pool)(tls.ConnectionState{PeerCertificates: c.certs}))
+
+			cfg := policy.TLSConfig(c.mx, &tls.Config{RootCAs: ca.pool})
+			check(cfg.VerifyConnection(tls.ConnectionState{PeerCertificates: c.certs}))
+		})
+	}
+}
+
+func TestPolicyTLSConfig_Resumption(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	cert, key := otherCA.issueKeyPair(t, "", []string{"mx.example.org"}, time.Now().Add(time.Hour))
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Make sure the session ticket is sent for TLS 1.3.
+			conn.Write([]byte{'a'})
+			conn.Close()
+		}
+	}()
+
+	dial := func(cfg *tls.Config) (tls.ConnectionState, error) {
+		t.Helper()
+		conn, err := tls.Dial("tcp", l.Addr().String(), cfg)
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.Close()
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		return conn.ConnectionState(), nil
+	}
+
+	// Opportunistic TLS config with the session cache shared with MTA-STS
+	// connections.
+	base := &tls.Config{
+		ServerName:         "mx.example.org",
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}
+	if _, err := dial(base); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := dial(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.DidResume {
+		t.Fatal("session is not resumed, test is not effective")
+	}
+
+	policy := Policy{
+		Mode:   ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.org"},
+	}
+	base.RootCAs = ca.pool
+	_, err = dial(policy.TLSConfig("mx.example.org", base))
+	verr, ok := err.(VerifyError)
+	if !ok || verr.Reason != VerifyUntrusted {
+		t.Fatalf("expected VerifyUntrusted for the resumed session, got %v", err)
+	}
+
+	// Caller-provided callback is not replaced.
+	called := false
+	base.RootCAs = otherCA.pool
+	base.VerifyConnection = func(tls.ConnectionState) error {
+		called = true
+		return nil
+	}
+	if _, err := dial(policy.TLSConfig("mx.example.org", base)); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Fatal("base.VerifyConnection is not called")
+	}
+}
@@ -0,0 +1,198 @@
+package tlsrpt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+)
+
+// Session describes the delivery attempt reported to Aggregator.
+type Session struct {
+	SendingMTAIP        string
+	ReceivingMXHostname string
+	ReceivingMXHelo     string
+	ReceivingIP         string
+}
+
+type aggKey struct {
+	domain string
+	day    time.Time
+}
+
+type failureKey struct {
+	resultType ResultType
+	sess       Session
+	reasonCode string
+}
+
+type policyAgg struct {
+	details  PolicyDetails
+	summary  Summary
+	failures map[failureKey]int64
+}
+
+type reportAgg struct {
+	// Keyed by policy text, the policy may change during the day.
+	policies map[string]*policyAgg
+}
+
+// Aggregator collects session results and builds daily reports for each
+// Policy Domain.
+//
+// It is goroutine-safe.
+type Aggregator struct {
+	OrganizationName string
+	ContactInfo      string
+
+	lock    sync.Mutex
+	reports map[aggKey]*reportAgg
+}
+
+func (a *Aggregator) policy(domain string, policy *mtasts.Policy, t time.Time) *policyAgg {
+	key := aggKey{domain: domain, day: t.UTC().Truncate(24 * time.Hour)}
+
+	if a.reports == nil {
+		a.reports = make(map[aggKey]*reportAgg)
+	}
+	rep, ok := a.reports[key]
+	if !ok {
+		rep = &reportAgg{policies: make(map[string]*policyAgg)}
+		a.reports[key] = rep
+	}
+
+	details := NewPolicyDetails(domain, policy)
+	policyKey := string(details.Type) + "\n" + strings.Join(details.String, "\n")
+	pol, ok := rep.policies[policyKey]
+	if !ok {
+		pol = &policyAgg{details: details, failures: make(map[failureKey]int64)}
+		rep.policies[policyKey] = pol
+	}
+	return pol
+}
+
+// AddSuccess records the successful session with the MX of domain that used
+// policy. policy can be nil if the domain has no policy.
+func (a *Aggregator) AddSuccess(domain string, policy *mtasts.Policy, t time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.policy(domain, policy, t).summary.TotalSuccessful++
+}
+
+// AddFailure records the failed session with the MX of domain that used
+// policy.
+//
+// reasonCode is an optional free-form string with additional information
+// about the failure.
+func (a *Aggregator) AddFailure(domain string, policy *mtasts.Policy, t time.Time, resultType ResultType, sess Session, reasonCode string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	pol := a.policy(domain, policy, t)
+	pol.summary.TotalFailure++
+	pol.failures[failureKey{resultType: resultType, sess: sess, reasonCode: reasonCode}]++
+}
+
+// AddOutcome records the session result as determined by mtasts.Decider.
+//
+// Policy fetch failures are recorded as failures, except for the case when
+// the domain simply does not publish a policy.
+func (a *Aggregator) AddOutcome(domain string, out mtasts.Outcome, t time.Time, sess Session) {
+	if out.Failure != nil {
+		a.AddFailure(domain, out.Policy, t, ResultTypeFor(out.Failure), sess, out.Failure.Error())
+		return
+	}
+
+	switch err := out.FetchErr.(type) {
+	case nil:
+	case mtasts.FetchError:
+		if err.Reason != mtasts.FetchNoRecord {
+			a.AddFailure(domain, nil, t, ResultTypeFor(err), sess, err.Error())
+			return
+		}
+	default:
+		if err != mtasts.ErrNoPolicy {
+			a.AddFailure(domain, nil, t, ResultSTSPolicyFetchError, sess, err.Error())
+			return
+		}
+	}
+	a.AddSuccess(domain, out.Policy, t)
+}
+
+func newReportID(day time.Time, domain string) string {
+	randBytes := make([]byte, 8)
+	if _, err := rand.Read(randBytes); err != nil {
+		panic(err)
+	}
+	return day.Format("2006-01-02") + "_" + domain + "_" + hex.EncodeToString(randBytes)
+}
+
+// Flush removes collected data for days that ended before t and returns
+// reports for them sorted by date and Policy Domain.
+func (a *Aggregator) Flush(t time.Time) []*Report {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var reports []*Report
+	for key, rep := range a.reports {
+		end := key.day.Add(24 * time.Hour)
+		if end.After(t) {
+			continue
+		}
+		delete(a.reports, key)
+
+		report := &Report{
+			OrganizationName: a.OrganizationName,
+			DateRange: DateRange{
+				Start: key.day,
+				End:   end.Add(-time.Second),
+			},
+			ContactInfo:  a.ContactInfo,
+			ReportID:     newReportID(key.day, key.domain),
+			PolicyDomain: key.domain,
+		}
+		for _, pol := range rep.policies {
+			res := PolicyResult{
+				Policy:  pol.details,
+				Summary: pol.summary,
+			}
+			for fkey, count := range pol.failures {
+				res.FailureDetails = append(res.FailureDetails, FailureDetails{
+					ResultType:          fkey.resultType,
+					SendingMTAIP:        fkey.sess.SendingMTAIP,
+					ReceivingMXHostname: fkey.sess.ReceivingMXHostname,
+					ReceivingMXHelo:     fkey.sess.ReceivingMXHelo,
+					ReceivingIP:         fkey.sess.ReceivingIP,
+					FailedSessionCount:  count,
+					FailureReasonCode:   fkey.reasonCode,
+				})
+			}
+			sort.Slice(res.FailureDetails, func(i, j int) bool {
+				fi, fj := res.FailureDetails[i], res.FailureDetails[j]
+				if fi.ResultType != fj.ResultType {
+					return fi.ResultType < fj.ResultType
+				}
+				return fi.ReceivingMXHostname < fj.ReceivingMXHostname
+			})
+			report.Policies = append(report.Policies, res)
+		}
+		sort.Slice(report.Policies, func(i, j int) bool {
+			return strings.Join(report.Policies[i].Policy.String, "\n") < strings.Join(report.Policies[j].Policy.String, "\n")
+		})
+
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		if !reports[i].DateRange.Start.Equal(reports[j].DateRange.Start) {
+			return reports[i].DateRange.Start.Before(reports[j].DateRange.Start)
+		}
+		return reports[i].PolicyDomain < reports[j].PolicyDomain
+	})
+	return reports
+}
@@ -0,0 +1,225 @@
+package tlsrpt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+)
+
+const (
+	// MediaTypeGzip is the media type of the gzip-compressed report.
+	MediaTypeGzip = "application/tlsrpt+gzip"
+	// MediaTypeJSON is the media type of the uncompressed report.
+	MediaTypeJSON = "application/tlsrpt+json"
+)
+
+type PolicyType string
+
+const (
+	PolicyTypeSTS      PolicyType = "sts"
+	PolicyTypeTLSA     PolicyType = "tlsa"
+	PolicyTypeNoPolicy PolicyType = "no-policy-found"
+)
+
+// ResultType is the failure type as defined in RFC 8460, Section 4.3.
+type ResultType string
+
+const (
+	// Negotiation failures.
+	ResultSTARTTLSNotSupported    ResultType = "starttls-not-supported"
+	ResultCertificateHostMismatch ResultType = "certificate-host-mismatch"
+	ResultCertificateExpired      ResultType = "certificate-expired"
+	ResultCertificateNotTrusted   ResultType = "certificate-not-trusted"
+	ResultValidationFailure       ResultType = "validation-failure"
+
+	// DANE-specific policy failures.
+	ResultTLSAInvalid   ResultType = "tlsa-invalid"
+	ResultDNSSECInvalid ResultType = "dnssec-invalid"
+	ResultDANERequired  ResultType = "dane-required"
+
+	// MTA-STS-specific policy failures.
+	ResultSTSPolicyFetchError ResultType = "sts-policy-fetch-error"
+	ResultSTSPolicyInvalid    ResultType = "sts-policy-invalid"
+	ResultSTSWebPKIInvalid    ResultType = "sts-webpki-invalid"
+)
+
+// ResultTypeFor returns the result type corresponding to the error returned
+// by mtasts.Cache.Get or policy verification functions.
+//
+// ResultValidationFailure is returned for unknown errors.
+func ResultTypeFor(err error) ResultType {
+	switch err := err.(type) {
+	case mtasts.VerifyError:
+		switch err.Reason {
+		case mtasts.VerifyNoSTARTTLS:
+			return ResultSTARTTLSNotSupported
+		case mtasts.VerifyTLSFailed:
+			if rt, ok := certResultType(err.Err); ok {
+				return rt
+			}
+			return ResultValidationFailure
+		case mtasts.VerifyHostMismatch:
+			return ResultCertificateHostMismatch
+		case mtasts.VerifyExpired:
+			return ResultCertificateExpired
+		case mtasts.VerifyUntrusted:
+			return ResultCertificateNotTrusted
+		}
+	case mtasts.FetchError:
+		switch err.Reason {
+		case mtasts.FetchDownloadFailed:
+			if isCertError(err.Err) {
+				return ResultSTSWebPKIInvalid
+			}
+			return ResultSTSPolicyFetchError
+		case mtasts.FetchHTTPStatus:
+			return ResultSTSPolicyFetchError
+		case mtasts.FetchMultipleRecords, mtasts.FetchMalformedRecord,
+			mtasts.FetchContentType, mtasts.FetchMalformedPolicy,
+			mtasts.FetchPolicyTooLarge, mtasts.FetchCharset:
+			return ResultSTSPolicyInvalid
+		}
+	}
+	return ResultValidationFailure
+}
+
+// certResultType returns the result type for the x509 error found in the
+// err chain, if any.
+func certResultType(err error) (ResultType, bool) {
+	for err != nil {
+		switch err := err.(type) {
+		case x509.UnknownAuthorityError:
+			return ResultCertificateNotTrusted, true
+		case x509.HostnameError:
+			return ResultCertificateHostMismatch, true
+		case x509.CertificateInvalidError:
+			if err.Reason == x509.Expired {
+				return ResultCertificateExpired, true
+			}
+			return ResultCertificateNotTrusted, true
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return "", false
+		}
+		err = u.Unwrap()
+	}
+	return "", false
+}
+
+func isCertError(err error) bool {
+	_, ok := certResultType(err)
+	return ok
+}
+
+type DateRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+type PolicyDetails struct {
+	Type   PolicyType `json:"policy-type"`
+	String []string   `json:"policy-string,omitempty"`
+	Domain string     `json:"policy-domain"`
+	MXHost []string   `json:"mx-host,omitempty"`
+}
+
+// NewPolicyDetails converts the MTA-STS policy for domain into the form used
+// in reports.
+//
+// If policy is nil, the policy type is set to "no-policy-found".
+func NewPolicyDetails(domain string, policy *mtasts.Policy) PolicyDetails {
+	if policy == nil {
+		return PolicyDetails{Type: PolicyTypeNoPolicy, Domain: domain}
+	}
+
+	details := PolicyDetails{
+		Type:   PolicyTypeSTS,
+		Domain: domain,
+		MXHost: policy.MX,
+	}
+
+	// The policy is reported as fetched, even if it does not pass
+	// Policy.Validate.
+	details.String = make([]string, 0, len(policy.MX)+3)
+	details.String = append(details.String, "version: STSv1", "mode: "+string(policy.Mode))
+	for _, mx := range policy.MX {
+		details.String = append(details.String, "mx: "+mx)
+	}
+	details.String = append(details.String, "max_age: "+strconv.Itoa(policy.MaxAge))
+	return details
+}
+
+type Summary struct {
+	TotalSuccessful int64 `json:"total-successful-session-count"`
+	TotalFailure    int64 `json:"total-failure-session-count"`
+}
+
+type FailureDetails struct {
+	ResultType            ResultType `json:"result-type"`
+	SendingMTAIP          string     `json:"sending-mta-ip,omitempty"`
+	ReceivingMXHostname   string     `json:"receiving-mx-hostname,omitempty"`
+	ReceivingMXHelo       string     `json:"receiving-mx-helo,omitempty"`
+	ReceivingIP           string     `json:"receiving-ip,omitempty"`
+	FailedSessionCount    int64      `json:"failed-session-count"`
+	AdditionalInformation string     `json:"additional-information,omitempty"`
+	FailureReasonCode     string     `json:"failure-reason-code,omitempty"`
+}
+
+type PolicyResult struct {
+	Policy         PolicyDetails    `json:"policy"`
+	Summary        Summary          `json:"summary"`
+	FailureDetails []FailureDetails `json:"failure-details,omitempty"`
+}
+
+// Report is the aggregate report as defined in RFC 8460, Section 4.
+type Report struct {
+	OrganizationName string         `json:"organization-name"`
+	DateRange        DateRange      `json:"date-range"`
+	ContactInfo      string         `json:"contact-info"`
+	ReportID         string         `json:"report-id"`
+	Policies         []PolicyResult `json:"policies"`
+
+	// The Policy Domain the report is about.
+	PolicyDomain string `json:"-"`
+}
+
+// WriteJSON writes the report as uncompressed JSON to w.
+func (r *Report) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+// WriteGzip writes the report as gzip-compressed JSON to w.
+func (r *Report) WriteGzip(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	if err := r.WriteJSON(gz); err != nil {
+		gz.Close()
+		return err
+	}
+	return gz.Close()
+}
+
+// Gzip returns the gzip-compressed JSON form of the report.
+func (r *Report) Gzip() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := r.WriteGzip(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Filename returns the file name for the gzip-compressed report as defined
+// in RFC 8460, Section 5.3.
+//
+// submitter is the domain of the reporting organization.
+func (r *Report) Filename(submitter string) string {
+	return fmt.Sprintf("%s!%s!%d!%d.json.gz", submitter, r.PolicyDomain,
+		r.DateRange.Start.Unix(), r.DateRange.End.Unix())
+}
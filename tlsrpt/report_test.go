@@ -0,0 +1,210 @@
+package tlsrpt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+)
+
+func TestResultTypeFor(t *testing.T) {
+	cases := []struct {
+		err        error
+		resultType ResultType
+	}{
+		{
+			err:        mtasts.VerifyError{Reason: mtasts.VerifyHostMismatch},
+			resultType: ResultCertificateHostMismatch,
+		},
+		{
+			err:        mtasts.VerifyError{Reason: mtasts.VerifyNoSTARTTLS},
+			resultType: ResultSTARTTLSNotSupported,
+		},
+		{
+			err:        mtasts.VerifyError{Reason: mtasts.VerifyTLSFailed, Err: errors.New("handshake failure")},
+			resultType: ResultValidationFailure,
+		},
+		{
+			err: mtasts.VerifyError{
+				Reason: mtasts.VerifyTLSFailed,
+				Err:    wrappedErr{err: x509.CertificateInvalidError{Reason: x509.Expired}},
+			},
+			resultType: ResultCertificateExpired,
+		},
+		{
+			err: mtasts.VerifyError{
+				Reason: mtasts.VerifyTLSFailed,
+				Err:    x509.HostnameError{Certificate: &x509.Certificate{}, Host: "mx.example.org"},
+			},
+			resultType: ResultCertificateHostMismatch,
+		},
+		{
+			err:        mtasts.VerifyError{Reason: mtasts.VerifyMXNotAllowed},
+			resultType: ResultValidationFailure,
+		},
+		{
+			err:        mtasts.FetchError{Reason: mtasts.FetchMalformedPolicy},
+			resultType: ResultSTSPolicyInvalid,
+		},
+		{
+			err:        mtasts.FetchError{Reason: mtasts.FetchHTTPStatus},
+			resultType: ResultSTSPolicyFetchError,
+		},
+		{
+			err: mtasts.FetchError{
+				Reason: mtasts.FetchDownloadFailed,
+				Err:    wrappedErr{err: x509.UnknownAuthorityError{}},
+			},
+			resultType: ResultSTSWebPKIInvalid,
+		},
+		{
+			err:        errors.New("unknown"),
+			resultType: ResultValidationFailure,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.err.Error(), func(t *testing.T) {
+			if rt := ResultTypeFor(c.err); rt != c.resultType {
+				t.Errorf("wrong result type, want %v, got %v", c.resultType, rt)
+			}
+		})
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	policy := &mtasts.Policy{
+		Mode:   mtasts.ModeEnforce,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.org"},
+	}
+	day := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	sess := Session{
+		SendingMTAIP:        "192.0.2.1",
+		ReceivingMXHostname: "mx.example.org",
+		ReceivingIP:         "192.0.2.2",
+	}
+
+	a := Aggregator{OrganizationName: "Example", ContactInfo: "tlsrpt@example.com"}
+	a.AddSuccess("example.org", policy, day.Add(time.Hour))
+	a.AddSuccess("example.org", policy, day.Add(2*time.Hour))
+	a.AddOutcome("example.org", mtasts.Outcome{
+		Decision: mtasts.DecisionDefer,
+		Policy:   policy,
+		Failure:  mtasts.VerifyError{Reason: mtasts.VerifyExpired, MX: "mx.example.org"},
+	}, day.Add(3*time.Hour), sess)
+	a.AddOutcome("example.org", mtasts.Outcome{
+		Decision: mtasts.DecisionDefer,
+		Policy:   policy,
+		Failure:  mtasts.VerifyError{Reason: mtasts.VerifyExpired, MX: "mx.example.org"},
+	}, day.Add(4*time.Hour), sess)
+	a.AddOutcome("example.net", mtasts.Outcome{
+		Decision: mtasts.DecisionDeliver,
+		FetchErr: mtasts.FetchError{Reason: mtasts.FetchNoRecord, Domain: "example.net"},
+	}, day.Add(time.Hour), sess)
+	// Next day, should not be flushed.
+	a.AddSuccess("example.org", policy, day.Add(25*time.Hour))
+
+	reports := a.Flush(day.Add(24 * time.Hour))
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 reports, got %d", len(reports))
+	}
+
+	netReport, orgReport := reports[0], reports[1]
+	if netReport.PolicyDomain != "example.net" || orgReport.PolicyDomain != "example.org" {
+		t.Fatalf("wrong report domains: %v, %v", netReport.PolicyDomain, orgReport.PolicyDomain)
+	}
+	if netReport.Policies[0].Policy.Type != PolicyTypeNoPolicy || netReport.Policies[0].Summary.TotalSuccessful != 1 {
+		t.Errorf("wrong no-policy report: %+v", netReport.Policies)
+	}
+
+	expected := []PolicyResult{
+		{
+			Policy: PolicyDetails{
+				Type:   PolicyTypeSTS,
+				String: []string{"version: STSv1", "mode: enforce", "mx: mx.example.org", "max_age: 86400"},
+				Domain: "example.org",
+				MXHost: []string{"mx.example.org"},
+			},
+			Summary: Summary{TotalSuccessful: 2, TotalFailure: 2},
+			FailureDetails: []FailureDetails{
+				{
+					ResultType:          ResultCertificateExpired,
+					SendingMTAIP:        "192.0.2.1",
+					ReceivingMXHostname: "mx.example.org",
+					ReceivingIP:         "192.0.2.2",
+					FailedSessionCount:  2,
+					FailureReasonCode:   "mtasts: mx.example.org: expired certificate",
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(orgReport.Policies, expected) {
+		t.Errorf("wrong report policies:\nwant %+v\ngot  %+v", expected, orgReport.Policies)
+	}
+	if !orgReport.DateRange.Start.Equal(day) || !orgReport.DateRange.End.Equal(day.Add(24*time.Hour-time.Second)) {
+		t.Errorf("wrong date range: %+v", orgReport.DateRange)
+	}
+	if name := orgReport.Filename("example.com"); name != "example.com!example.org!1554076800!1554163199.json.gz" {
+		t.Errorf("wrong file name: %v", name)
+	}
+
+	if reports := a.Flush(day.Add(24 * time.Hour)); len(reports) != 0 {
+		t.Fatalf("expected flushed reports to be removed, got %d", len(reports))
+	}
+}
+
+func TestReportGzip(t *testing.T) {
+	r := &Report{
+		OrganizationName: "Example",
+		ReportID:         "1",
+		PolicyDomain:     "example.org",
+		Policies: []PolicyResult{
+			{
+				Policy:  NewPolicyDetails("example.org", nil),
+				Summary: Summary{TotalSuccessful: 1},
+			},
+		},
+	}
+
+	blob, err := r.Gzip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.NewDecoder(gz).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"organization-name", "date-range", "contact-info", "report-id", "policies"} {
+		if _, ok := decoded[key]; !ok {
+			t.Errorf("missing %s key in the report", key)
+		}
+	}
+	policies := decoded["policies"].([]interface{})
+	policy := policies[0].(map[string]interface{})["policy"].(map[string]interface{})
+	if policy["policy-type"] != "no-policy-found" {
+		t.Errorf("wrong policy-type: %v", policy["policy-type"])
+	}
+}
+
+type wrappedErr struct {
+	err error
+}
+
+func (e wrappedErr) Error() string {
+	return "wrapped: " + e.err.Error()
+}
+
+func (e wrappedErr) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,246 @@
+package tlsrpt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SubmitError is returned by Submitter.Submit when the report was not
+// delivered to some of rua URIs.
+type SubmitError struct {
+	// Errors keyed by the rua URI.
+	Errs map[string]error
+}
+
+func (e SubmitError) Error() string {
+	uris := make([]string, 0, len(e.Errs))
+	for uri := range e.Errs {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+
+	parts := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		parts = append(parts, uri+": "+e.Errs[uri].Error())
+	}
+	return "mtasts/tlsrpt: report submission failed: " + strings.Join(parts, "; ")
+}
+
+var httpClient = &http.Client{
+	Timeout: time.Minute,
+}
+
+// Submitter delivers aggregate reports to rua URIs.
+type Submitter struct {
+	// Domain of the reporting organization. Used in file names and
+	// TLS-Report-Submitter header.
+	Domain string
+
+	// From address for the report messages.
+	From string
+
+	// HTTP client used for https: URIs. If nil, the client with a one minute
+	// timeout is used.
+	HTTPClient *http.Client
+
+	// SendMail is called to deliver messages generated for mailto: URIs.
+	// If nil, mailto: URIs are reported as failed.
+	SendMail func(ctx context.Context, from string, to []string, msg []byte) error
+}
+
+// Submit delivers the report to all rua URIs from the record.
+//
+// The delivery is attempted for each URI, SubmitError is returned if some of
+// them failed.
+func (s *Submitter) Submit(ctx context.Context, rec *Record, r *Report) error {
+	errs := make(map[string]error)
+	for _, uri := range rec.RUA {
+		var err error
+		switch strings.ToLower(uri.Scheme) {
+		case "https":
+			err = s.Post(ctx, uri, r)
+		case "mailto":
+			err = s.mail(ctx, uri, r)
+		default:
+			err = errors.New("unsupported URI scheme")
+		}
+		if err != nil {
+			errs[uri.String()] = err
+		}
+	}
+	if len(errs) != 0 {
+		return SubmitError{Errs: errs}
+	}
+	return nil
+}
+
+// Post submits the gzip-compressed report to the https: URI as defined in
+// RFC 8460, Section 5.4.
+func (s *Submitter) Post(ctx context.Context, uri *url.URL, r *Report) error {
+	blob, err := r.Gzip()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", uri.String(), bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", MediaTypeGzip)
+
+	client := s.HTTPClient
+	if client == nil {
+		client = httpClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("mtasts/tlsrpt: unexpected HTTP status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *Submitter) mail(ctx context.Context, uri *url.URL, r *Report) error {
+	if s.SendMail == nil {
+		return errors.New("mtasts/tlsrpt: mail submission is not configured")
+	}
+
+	addr, err := url.PathUnescape(uri.Opaque)
+	if err != nil {
+		return err
+	}
+	var to []string
+	for _, a := range strings.Split(addr, ",") {
+		parsed, err := mail.ParseAddress(a)
+		if err != nil {
+			return fmt.Errorf("mtasts/tlsrpt: malformed rua address: %w", err)
+		}
+		to = append(to, parsed.Address)
+	}
+
+	msg, err := s.MailMessage(to, r)
+	if err != nil {
+		return err
+	}
+	return s.SendMail(ctx, s.From, to, msg)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// checkHeaderValue rejects values that would break the message header.
+func checkHeaderValue(field, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("mtasts/tlsrpt: line break in %s", field)
+	}
+	return nil
+}
+
+// MailMessage generates the report message as defined in RFC 8460, Section
+// 5.3.
+//
+// Each to element should be a single address as accepted by
+// mail.ParseAddress.
+//
+// The message uses CRLF line endings and is ready to be submitted for
+// delivery.
+func (s *Submitter) MailMessage(to []string, r *Report) ([]byte, error) {
+	for _, f := range []struct{ name, value string }{
+		{"From", s.From},
+		{"Domain", s.Domain},
+		{"PolicyDomain", r.PolicyDomain},
+		{"ReportID", r.ReportID},
+	} {
+		if err := checkHeaderValue(f.name, f.value); err != nil {
+			return nil, err
+		}
+	}
+	toAddrs := make([]string, 0, len(to))
+	for _, a := range to {
+		parsed, err := mail.ParseAddress(a)
+		if err != nil {
+			return nil, fmt.Errorf("mtasts/tlsrpt: malformed recipient address: %w", err)
+		}
+		toAddrs = append(toAddrs, parsed.String())
+	}
+
+	blob, err := r.Gzip()
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	textHdr := textproto.MIMEHeader{}
+	textHdr.Set("Content-Type", "text/plain; charset=us-ascii")
+	textPart, err := mw.CreatePart(textHdr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(textPart, "This is an aggregate TLS report from %s for %s.\r\n", s.Domain, r.PolicyDomain)
+
+	reportHdr := textproto.MIMEHeader{}
+	reportHdr.Set("Content-Type", MediaTypeGzip)
+	reportHdr.Set("Content-Transfer-Encoding", "base64")
+	reportHdr.Set("Content-Disposition", `attachment; filename="`+r.Filename(s.Domain)+`"`)
+	reportPart, err := mw.CreatePart(reportHdr)
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	for len(encoded) > 76 {
+		fmt.Fprintf(reportPart, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(reportPart, "%s\r\n", encoded)
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	hdr := []struct{ k, v string }{
+		{"From", s.From},
+		{"To", strings.Join(toAddrs, ", ")},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + randomHex(16) + "@" + s.Domain + ">"},
+		{"Subject", "Report Domain: " + r.PolicyDomain + " Submitter: " + s.Domain + " Report-ID: <" + r.ReportID + ">"},
+		{"TLS-Report-Domain", r.PolicyDomain},
+		{"TLS-Report-Submitter", s.Domain},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `multipart/report; report-type="tlsrpt"; boundary="` + mw.Boundary() + `"`},
+	}
+	for _, f := range hdr {
+		msg.WriteString(f.k + ": " + f.v + "\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,213 @@
+package tlsrpt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testReport() *Report {
+	return &Report{
+		OrganizationName: "Example",
+		DateRange: DateRange{
+			Start: time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC),
+			End:   time.Date(2019, 4, 1, 23, 59, 59, 0, time.UTC),
+		},
+		ContactInfo:  "tlsrpt@example.com",
+		ReportID:     "2019-04-01_example.org_1",
+		PolicyDomain: "example.org",
+		Policies: []PolicyResult{
+			{
+				Policy:  NewPolicyDetails("example.org", nil),
+				Summary: Summary{TotalSuccessful: 1},
+			},
+		},
+	}
+}
+
+func decodeGzipReport(t *testing.T, r io.Reader) *Report {
+	t.Helper()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &Report{}
+	if err := json.NewDecoder(gz).Decode(report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestSubmitter_Post(t *testing.T) {
+	var received *Report
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != MediaTypeGzip {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		received = decodeGzipReport(t, r.Body)
+	}))
+	defer srv.Close()
+
+	rec, err := ParseRecord("v=TLSRPTv1; rua=" + srv.URL + "/tlsrpt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Submitter{Domain: "example.com", HTTPClient: srv.Client()}
+	if err := s.Submit(context.Background(), rec, testReport()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := testReport()
+	expected.PolicyDomain = ""
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("wrong report received:\nwant %+v\ngot  %+v", expected, received)
+	}
+}
+
+func TestSubmitter_PostError(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	rec, err := ParseRecord("v=TLSRPTv1; rua=" + srv.URL + "/tlsrpt,mailto:tlsrpt@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Submitter{Domain: "example.com", HTTPClient: srv.Client()}
+	err = s.Submit(context.Background(), rec, testReport())
+	serr, ok := err.(SubmitError)
+	if !ok {
+		t.Fatalf("expected SubmitError, got %T: %v", err, err)
+	}
+	if len(serr.Errs) != 2 {
+		t.Fatalf("expected both URIs to fail, got %v", serr.Errs)
+	}
+}
+
+func TestSubmitter_Mail(t *testing.T) {
+	rec, err := ParseRecord("v=TLSRPTv1; rua=mailto:tlsrpt@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		sentFrom string
+		sentTo   []string
+		sentMsg  []byte
+	)
+	s := Submitter{
+		Domain: "example.com",
+		From:   "noreply@example.com",
+		SendMail: func(_ context.Context, from string, to []string, msg []byte) error {
+			sentFrom, sentTo, sentMsg = from, to, msg
+			return nil
+		},
+	}
+	if err := s.Submit(context.Background(), rec, testReport()); err != nil {
+		t.Fatal(err)
+	}
+
+	if sentFrom != "noreply@example.com" || !reflect.DeepEqual(sentTo, []string{"tlsrpt@example.org"}) {
+		t.Fatalf("wrong envelope: %v -> %v", sentFrom, sentTo)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(sentMsg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := msg.Header.Get("TLS-Report-Domain"); v != "example.org" {
+		t.Errorf("wrong TLS-Report-Domain: %v", v)
+	}
+	if v := msg.Header.Get("TLS-Report-Submitter"); v != "example.com" {
+		t.Errorf("wrong TLS-Report-Submitter: %v", v)
+	}
+	const subject = "Report Domain: example.org Submitter: example.com Report-ID: <2019-04-01_example.org_1>"
+	if v := msg.Header.Get("Subject"); v != subject {
+		t.Errorf("wrong Subject: %v", v)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/report" || params["report-type"] != "tlsrpt" {
+		t.Fatalf("wrong Content-Type: %v", msg.Header.Get("Content-Type"))
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	reportPart, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := reportPart.Header.Get("Content-Type"); ct != MediaTypeGzip {
+		t.Fatalf("wrong report part Content-Type: %v", ct)
+	}
+	if fn := reportPart.FileName(); fn != "example.com!example.org!1554076800!1554163199.json.gz" {
+		t.Errorf("wrong report file name: %v", fn)
+	}
+	encoded, err := ioutil.ReadAll(reportPart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := base64.StdEncoding.DecodeString(string(bytes.Replace(encoded, []byte("\r\n"), nil, -1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := testReport()
+	expected.PolicyDomain = ""
+	if received := decodeGzipReport(t, bytes.NewReader(blob)); !reflect.DeepEqual(received, expected) {
+		t.Fatalf("wrong report attached:\nwant %+v\ngot  %+v", expected, received)
+	}
+}
+
+func TestSubmitter_MailInjection(t *testing.T) {
+	sent := false
+	s := Submitter{
+		Domain: "example.com",
+		From:   "noreply@example.com",
+		SendMail: func(context.Context, string, []string, []byte) error {
+			sent = true
+			return nil
+		},
+	}
+
+	rec, err := ParseRecord("v=TLSRPTv1; rua=mailto:a@example.org%0D%0ABcc:%20victim@evil.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Submit(context.Background(), rec, testReport()); err == nil {
+		t.Error("expected error for the address with line break")
+	}
+	if sent {
+		t.Error("message with injected header sent")
+	}
+
+	r := testReport()
+	r.ReportID = "1>\r\nBcc: victim@evil.example"
+	if _, err := s.MailMessage([]string{"tlsrpt@example.org"}, r); err == nil {
+		t.Error("expected error for ReportID with line break")
+	}
+	if _, err := s.MailMessage([]string{"a@example.org\r\nBcc: victim@evil.example"}, testReport()); err == nil {
+		t.Error("expected error for recipient with line break")
+	}
+}
@@ -0,0 +1,217 @@
+// Package tlsrpt implements SMTP TLS Reporting (RFC 8460) record discovery,
+// report generation and submission.
+package tlsrpt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/foxcpp/go-mtasts"
+)
+
+type MalformedRecordError struct {
+	// Additional description of the error.
+	Desc string
+}
+
+func (e MalformedRecordError) Error() string {
+	return fmt.Sprintf("mtasts/tlsrpt: malformed DNS record: %s", e.Desc)
+}
+
+// ErrNoRecord is returned by Lookup when the domain does not publish a
+// usable TLSRPT record.
+var ErrNoRecord = errors.New("mtasts/tlsrpt: no record")
+
+// Extension is a single extension key-value pair from the TLSRPT TXT record.
+type Extension struct {
+	Key   string
+	Value string
+}
+
+// Record is the parsed form of the _smtp._tls TXT record (RFC 8460,
+// Section 3).
+type Record struct {
+	// Version of the record, always "TLSRPTv1".
+	Version string
+
+	// Aggregate report URIs, either mailto: or https:.
+	RUA []*url.URL
+
+	// Extension fields in the order they appear in the record.
+	Extensions []Extension
+}
+
+// String returns the record in the TXT record value format.
+func (r Record) String() string {
+	version := r.Version
+	if version == "" {
+		version = "TLSRPTv1"
+	}
+
+	uris := make([]string, 0, len(r.RUA))
+	for _, u := range r.RUA {
+		uris = append(uris, u.String())
+	}
+
+	var b strings.Builder
+	b.WriteString("v=" + version + "; rua=" + strings.Join(uris, ","))
+	for _, ext := range r.Extensions {
+		b.WriteString("; " + ext.Key + "=" + ext.Value)
+	}
+	return b.String()
+}
+
+func isAlnum(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+func validExtName(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for i, r := range name {
+		if isAlnum(r) {
+			continue
+		}
+		if i != 0 && (r == '_' || r == '-' || r == '.') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func validExtValue(value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for _, r := range value {
+		// tlsrpt-ext-value = 1*(%x21-3A / %x3C / %x3E-7E)
+		if r < 0x21 || r > 0x7E || r == ';' || r == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+func parseRUA(value string) ([]*url.URL, error) {
+	parts := strings.Split(value, ",")
+	uris := make([]*url.URL, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, MalformedRecordError{Desc: "empty rua URI"}
+		}
+		u, err := url.Parse(part)
+		if err != nil {
+			return nil, MalformedRecordError{Desc: "invalid rua URI: " + err.Error()}
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "mailto":
+			if u.Opaque == "" {
+				return nil, MalformedRecordError{Desc: "missing address in rua URI: " + part}
+			}
+		case "https":
+			if u.Host == "" {
+				return nil, MalformedRecordError{Desc: "missing host in rua URI: " + part}
+			}
+		default:
+			return nil, MalformedRecordError{Desc: "unsupported rua URI scheme: " + part}
+		}
+		uris = append(uris, u)
+	}
+	return uris, nil
+}
+
+// ParseRecord parses the value of the _smtp._tls TXT record.
+func ParseRecord(raw string) (*Record, error) {
+	parts := strings.Split(raw, ";")
+	rec := Record{}
+	versionPresent := false
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		// handle k=v;k=v;
+		//				 ^
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, MalformedRecordError{Desc: "invalid record part: " + part}
+		}
+
+		if strings.ContainsAny(kv[0], " \t") {
+			return nil, MalformedRecordError{Desc: "whitespace is not allowed in name"}
+		}
+
+		switch kv[0] {
+		case "v":
+			if i != 0 {
+				return nil, MalformedRecordError{Desc: "version must be the first field"}
+			}
+			if kv[1] != "TLSRPTv1" {
+				return nil, MalformedRecordError{Desc: "unsupported version: " + kv[1]}
+			}
+			rec.Version = kv[1]
+			versionPresent = true
+		case "rua":
+			if rec.RUA != nil {
+				return nil, MalformedRecordError{Desc: "duplicate rua field"}
+			}
+			uris, err := parseRUA(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			rec.RUA = uris
+		default:
+			if !validExtName(kv[0]) {
+				return nil, MalformedRecordError{Desc: "invalid extension name: " + kv[0]}
+			}
+			if !validExtValue(kv[1]) {
+				return nil, MalformedRecordError{Desc: "invalid extension value: " + kv[1]}
+			}
+			rec.Extensions = append(rec.Extensions, Extension{Key: kv[0], Value: kv[1]})
+		}
+	}
+	if !versionPresent {
+		return nil, MalformedRecordError{Desc: "missing version value"}
+	}
+	if len(rec.RUA) == 0 {
+		return nil, MalformedRecordError{Desc: "missing rua value"}
+	}
+	return &rec, nil
+}
+
+// Lookup discovers the TLSRPT record for the domain.
+//
+// The domain is assumed to be normalized, as done by dns.ForLookup.
+//
+// ErrNoRecord is returned if the domain does not publish the record, or
+// publishes more than one. MalformedRecordError is returned if the record is
+// syntactically invalid. Temporary DNS errors are returned as is.
+func Lookup(ctx context.Context, r mtasts.Resolver, domain string) (*Record, error) {
+	records, err := r.LookupTXT(ctx, "_smtp._tls."+domain)
+	if err != nil {
+		if derr, ok := err.(*net.DNSError); ok && !derr.IsTemporary {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+
+	// Records that do not begin with "v=TLSRPTv1;" are discarded.
+	var found []string
+	for _, rec := range records {
+		if strings.HasPrefix(rec, "v=TLSRPTv1") {
+			found = append(found, rec)
+		}
+	}
+	if len(found) != 1 {
+		return nil, ErrNoRecord
+	}
+
+	return ParseRecord(found[0])
+}
@@ -0,0 +1,135 @@
+package tlsrpt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/go-mockdns"
+)
+
+func TestParseRecord(t *testing.T) {
+	cases := []struct {
+		value string
+		rua   []string
+		fail  bool
+	}{
+		{
+			value: "",
+			fail:  true,
+		},
+		{
+			value: "v=TLSRPTv1",
+			fail:  true,
+		},
+		{
+			value: "rua=mailto:tlsrpt@example.org; v=TLSRPTv1",
+			fail:  true,
+		},
+		{
+			value: "v=TLSRPTv2; rua=mailto:tlsrpt@example.org",
+			fail:  true,
+		},
+		{
+			value: "v=TLSRPTv1; rua=http://example.org/tlsrpt",
+			fail:  true,
+		},
+		{
+			value: "v=TLSRPTv1; rua=mailto:",
+			fail:  true,
+		},
+		{
+			value: "v=TLSRPTv1; rua=mailto:tlsrpt@example.org,",
+			fail:  true,
+		},
+		{
+			value: "v=TLSRPTv1; rua=mailto:a@example.org; rua=mailto:b@example.org",
+			fail:  true,
+		},
+		{
+			value: "v=TLSRPTv1; rua=mailto:tlsrpt@example.org; _bad=1",
+			fail:  true,
+		},
+		{
+			value: "v=TLSRPTv1;rua=mailto:tlsrpt@example.org",
+			rua:   []string{"mailto:tlsrpt@example.org"},
+		},
+		{
+			value: "v=TLSRPTv1; rua=mailto:tlsrpt@example.org,https://reporting.example.org/v1/tlsrpt; ext=1",
+			rua:   []string{"mailto:tlsrpt@example.org", "https://reporting.example.org/v1/tlsrpt"},
+		},
+		{
+			value: "v=TLSRPTv1; rua=mailto:tlsrpt@example.org?subject=a%2Cb",
+			rua:   []string{"mailto:tlsrpt@example.org?subject=a%2Cb"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			rec, err := ParseRecord(c.value)
+			if c.fail {
+				if err == nil {
+					t.Errorf("expected failure, got %+v", rec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected failure: %v", err)
+			}
+			if len(rec.RUA) != len(c.rua) {
+				t.Fatalf("wrong rua list, want %v, got %v", c.rua, rec.RUA)
+			}
+			for i, u := range rec.RUA {
+				if u.String() != c.rua[i] {
+					t.Errorf("wrong rua URI, want %v, got %v", c.rua[i], u)
+				}
+			}
+
+			reparsed, err := ParseRecord(rec.String())
+			if err != nil {
+				t.Fatalf("String output is not parseable: %v", err)
+			}
+			if reparsed.String() != rec.String() {
+				t.Errorf("round-trip mismatch, want %q, got %q", rec.String(), reparsed.String())
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	r := &mockdns.Resolver{
+		Zones: map[string]mockdns.Zone{
+			"_smtp._tls.example.org.": {
+				TXT: []string{"unrelated", "v=TLSRPTv1; rua=mailto:tlsrpt@example.org"},
+			},
+			"_smtp._tls.multiple.example.org.": {
+				TXT: []string{
+					"v=TLSRPTv1; rua=mailto:tlsrpt@example.org",
+					"v=TLSRPTv1; rua=mailto:tlsrpt2@example.org",
+				},
+			},
+			"_smtp._tls.broken.example.org.": {
+				TXT: []string{"v=TLSRPTv1; rua=ftp://example.org"},
+			},
+		},
+	}
+
+	rec, err := Lookup(context.Background(), r, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.RUA) != 1 || rec.RUA[0].String() != "mailto:tlsrpt@example.org" {
+		t.Fatalf("wrong record returned: %+v", rec)
+	}
+
+	if _, err := Lookup(context.Background(), r, "multiple.example.org"); err != ErrNoRecord {
+		t.Fatalf("expected ErrNoRecord, got %v", err)
+	}
+	if _, err := Lookup(context.Background(), r, "missing.example.org"); err != ErrNoRecord {
+		t.Fatalf("expected ErrNoRecord, got %v", err)
+	}
+	if _, err := Lookup(context.Background(), r, "broken.example.org"); err == nil {
+		t.Fatal("expected an error for malformed record")
+	} else if _, ok := err.(MalformedRecordError); !ok {
+		t.Fatalf("expected MalformedRecordError, got %T: %v", err, err)
+	}
+}